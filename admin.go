@@ -0,0 +1,178 @@
+package vuvuzela
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// LastHop stands for the position of the last server, whatever the length
+// of the chain.
+const LastHop = -1
+
+// ServerOptions are what the server commands are told on their command
+// line about their keys and doctrine.
+type ServerOptions struct {
+	// TopologyPath is TopologyFile in the server's home if empty. Chain
+	// overrides it.
+	TopologyPath string
+	Chain        string
+	// SuiteName is the crypto suite of a new key pair.
+	SuiteName string
+	// Force and NoOverwrite say what happens to a key pair in the way of
+	// a new one, see OverwriteModeOf.
+	Force       bool
+	NoOverwrite bool
+	// OperatorHome, if set, has the operator key new doctrines are
+	// signed with right away.
+	OperatorHome string
+	Validity     time.Duration
+	Version      uint64
+	// Overlap is how long the old key keeps working after a rotation.
+	Overlap time.Duration
+}
+
+// LoadTopology loads the topology of the server whose home is
+// doctrineHome.
+func (o *ServerOptions) LoadTopology(doctrineHome string) (*Topology, error) {
+	path := o.TopologyPath
+	if path == "" {
+		path = filepath.Join(doctrineHome, TopologyFile)
+	}
+	return LoadTopology(path, o.Chain)
+}
+
+// InitServer creates the key pair, and with OperatorHome the doctrine, of
+// the server at position hop in doctrineHome. It returns an *ExistsError
+// if there is a key pair already that has to stay.
+func InitServer(doctrineHome string, hop int, o *ServerOptions) error {
+	mode, err := OverwriteModeOf(o.Force, o.NoOverwrite)
+	if err != nil {
+		return err
+	}
+	suite, err := SuiteByName(o.SuiteName)
+	if err != nil {
+		return err
+	}
+	err = MakeHome(doctrineHome)
+	if err != nil {
+		return err
+	}
+	// whatever signing the doctrine needs is checked before an existing
+	// key pair is replaced
+	var topology *Topology
+	if o.OperatorHome != "" {
+		topology, err = o.LoadTopology(doctrineHome)
+		if err != nil {
+			return fmt.Errorf("load topology: %s", err)
+		}
+		if hop == LastHop {
+			hop = len(topology.Servers) - 1
+		}
+		_, err = os.Stat(filepath.Join(o.OperatorHome, PrivateKeyFile))
+		if err != nil {
+			return fmt.Errorf("operator key: %s", err)
+		}
+	}
+
+	fmt.Printf("--> Generating server key pair and doctrine.\n")
+	err = Overwrite(filepath.Join(doctrineHome, PrivateKeyFile), mode)
+	if err != nil {
+		return err
+	}
+	_, err = WriteNewKey(doctrineHome, suite)
+	if err != nil {
+		return fmt.Errorf("generate key: %s", err)
+	}
+	publicKeyPath := filepath.Join(doctrineHome, PublicKeyFile)
+	if o.OperatorHome == "" {
+		fmt.Printf("! Wrote new key pair, have the operator sign %s with operator -sign,\n", publicKeyPath)
+		fmt.Printf("! then put the doctrine in %s and the operator's public key in %s.\n",
+			filepath.Join(doctrineHome, DoctrineFile), filepath.Join(doctrineHome, RootKeyFile))
+		return nil
+	}
+	err = SignServerDoctrine(doctrineHome, o.OperatorHome, topology, hop, o.Validity, o.Version)
+	if err != nil {
+		return fmt.Errorf("write doctrine: %s", err)
+	}
+	fmt.Printf("! Wrote new config file: %s\n", filepath.Join(doctrineHome, DoctrineFile))
+	fmt.Printf("--> Done.\n")
+	return nil
+}
+
+// RotateServerKey replaces the key pair in doctrineHome, and with
+// OperatorHome signs the doctrine that publishes both keys.
+func RotateServerKey(doctrineHome string, o *ServerOptions) error {
+	fmt.Printf("--> Rotating server key pair.\n")
+	_, old, until, err := RotateKey(doctrineHome, o.Overlap)
+	if err != nil {
+		return err
+	}
+	if o.OperatorHome == "" {
+		fmt.Printf("! Wrote new key pair, have the operator sign %s with operator -sign -old %s -old-until %s,\n",
+			filepath.Join(doctrineHome, PublicKeyFile), filepath.Join(doctrineHome, OldPublicKeyFile), until.Format(time.RFC3339))
+		fmt.Printf("! then put the doctrine in %s.\n", filepath.Join(doctrineHome, DoctrineFile))
+	} else {
+		err = SignRotatedDoctrine(doctrineHome, o.OperatorHome, old, until, o.Validity)
+		if err != nil {
+			return fmt.Errorf("write doctrine: %s", err)
+		}
+		fmt.Printf("! Wrote new config file: %s\n", filepath.Join(doctrineHome, DoctrineFile))
+	}
+	fmt.Printf("! Send the running server a SIGHUP to load the new key, and rebuild the network doctrine.\n")
+	fmt.Printf("! The old key is retired on %s.\n", until.Format(time.RFC3339))
+	fmt.Printf("--> Done.\n")
+	return nil
+}
+
+// SignNetworkDoctrine adds the signature of the server in doctrineHome to
+// the network doctrine at path. A server vouches only for the privacy it
+// adds noise for: privacy is nil for the last server, which adds none.
+func SignNetworkDoctrine(doctrineHome, path string, privacy *PrivacyBudget) error {
+	suite, privateKey, err := ReadPrivateKey(doctrineHome)
+	if err != nil {
+		return fmt.Errorf("read key pair: %s", err)
+	}
+	nd, err := ReadNetworkDoctrine(path)
+	if err != nil {
+		return fmt.Errorf("read network doctrine: %s", err)
+	}
+	if privacy != nil && nd.Privacy != *privacy {
+		return fmt.Errorf("network doctrine promises %s, we run with %s", nd.Privacy, *privacy)
+	}
+	err = nd.Sign(suite, privateKey)
+	if err != nil {
+		return fmt.Errorf("sign network doctrine: %s", err)
+	}
+	err = WriteNetworkDoctrine(path, nd)
+	if err != nil {
+		return fmt.Errorf("write network doctrine: %s", err)
+	}
+	fmt.Printf("! Signed network doctrine version %d: %s\n", nd.Version, path)
+	return nil
+}
+
+// ReloadOnHangup reads keys again on every SIGHUP, e.g. after a rotation,
+// then calls refresh if it is not nil.
+func ReloadOnHangup(keys *KeyRing, refresh func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		err := keys.Reload()
+		if err != nil {
+			fmt.Printf("reload keys error: %s\n", err)
+		} else {
+			fmt.Printf("reloaded keys\n")
+		}
+		if refresh == nil {
+			continue
+		}
+		err = refresh()
+		if err != nil {
+			fmt.Printf("refresh error: %s\n", err)
+		}
+	}
+}
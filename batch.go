@@ -0,0 +1,80 @@
+package vuvuzela
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	SizeBatchCount  = 4
+	SizeBatchHeader = 1 + SizeRound + SizeBatchCount
+	MaxBatchCount   = 1 << 20
+)
+
+// A batch starts with the kind and round it belongs to. The same values
+// are used as the sequence byte of onion layers and in announcements to
+// say what kind of round is open.
+const (
+	BatchConvo byte = 1
+	BatchDial  byte = 2
+	// Register is the kind of the onion a client introduces itself to
+	// the entry server with. It is never part of a batch.
+	Register byte = 0
+)
+
+// EncodeBatch lays out a batch as its kind, round, a 4 byte big endian
+// count and the messages back to back. All messages of a batch have the
+// same size.
+func EncodeBatch(kind byte, round uint32, msgs [][]byte) []byte {
+	size := 0
+	if len(msgs) > 0 {
+		size = len(msgs[0])
+	}
+	buf := make([]byte, SizeBatchHeader, SizeBatchHeader+len(msgs)*size)
+	buf[0] = kind
+	binary.BigEndian.PutUint32(buf[1:], round)
+	binary.BigEndian.PutUint32(buf[1+SizeRound:], uint32(len(msgs)))
+	for _, msg := range msgs {
+		buf = append(buf, msg...)
+	}
+	return buf
+}
+
+// ParseBatch splits a batch made by EncodeBatch whose messages are size
+// bytes long.
+func ParseBatch(payload []byte, size int) (kind byte, round uint32, msgs [][]byte, err error) {
+	if len(payload) < SizeBatchHeader {
+		return 0, 0, nil, fmt.Errorf("batch of %d bytes is too short", len(payload))
+	}
+	kind = payload[0]
+	round = binary.BigEndian.Uint32(payload[1:])
+	count := binary.BigEndian.Uint32(payload[1+SizeRound:])
+	if count > MaxBatchCount {
+		return 0, 0, nil, fmt.Errorf("batch of %d messages is too large", count)
+	}
+	body := payload[SizeBatchHeader:]
+	if len(body) != int(count)*size {
+		return 0, 0, nil, fmt.Errorf("batch of %d messages of %d bytes has %d bytes", count, size, len(body))
+	}
+	msgs = make([][]byte, count)
+	for i := range msgs {
+		msgs[i] = body[i*size : (i+1)*size]
+	}
+	return kind, round, msgs, nil
+}
+
+// WriteBatch sends a batch in a frame of type typ.
+func WriteBatch(w io.Writer, typ, kind byte, round uint32, msgs [][]byte) error {
+	return WriteFrame(w, typ, EncodeBatch(kind, round, msgs))
+}
+
+// ReadBatch reads a batch sent by WriteBatch in a frame of type typ whose
+// messages are size bytes long.
+func ReadBatch(r io.Reader, typ byte, size int) (byte, uint32, [][]byte, error) {
+	payload, err := ExpectFrame(r, typ, MaxFrameSize)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return ParseBatch(payload, size)
+}
@@ -0,0 +1,460 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	MaxQueuedMessages       = 64
+	MaxQueuedInvitations    = 8
+	MaxPendingReplies       = 16
+	MaxPendingAnnouncements = 4
+)
+
+// UI is where a Client shows the user what is going on: messages as they
+// come and a status line that is redrawn as rounds go by.
+type UI interface {
+	Printf(format string, args ...interface{})
+	SetStatus(format string, args ...interface{})
+}
+
+// Client is a long running conversation over one connection to the entry
+// server. To hide when the user is talking, it answers every round the
+// entry server announces with exactly one onion of the same size whatever
+// the user does: the next queued message, an empty message when there is
+// nothing to say, or a fake onion to a random dead drop when there is no
+// conversation at all. Dialing rounds get the same treatment with
+// invitations.
+type Client struct {
+	// LoadNetwork, if set, fetches the network again every
+	// NetworkDoctrineMaxAge while the client runs, so onions go to the
+	// new keys of servers that rotated theirs before the old ones are
+	// retired.
+	LoadNetwork func() (*Network, error)
+
+	conn         net.Conn
+	network      *Network
+	privateKey   PrivateKey
+	doctrineHome string
+	ui           UI
+
+	announcements chan *announcement
+	outgoing      chan []byte
+	invitations   chan []byte
+
+	mu sync.Mutex
+	// publicKeys are the keys of the network, which change when the
+	// network is fetched again.
+	publicKeys []PublicKey
+	pending    map[uint32][][]byte
+	convo      *Conversation
+	peerName   string
+	round      uint32
+	dialRound  uint32
+}
+
+// announcement is the entry server telling us a round is open.
+type announcement struct {
+	kind     byte
+	round    uint32
+	deadline time.Time
+}
+
+// Dial connects to the entry server of network and registers the owner
+// of privateKey, a key of the network's suite, with it. Invitations from
+// callers are saved in doctrineHome.
+func Dial(network *Network, privateKey PrivateKey, doctrineHome string, ui UI) (*Client, error) {
+	suite := network.Suite
+	// the register onion is padded to the size of a real onion for the
+	// rest of the chain, so the entry server sees fixed size messages.
+	registerbuf := make([]byte, OnionSize(suite, len(network.PublicKeys)-1))
+	copy(registerbuf, privateKey.Public().Bytes())
+	registerOnion, _, err := WrapOnion(suite, network.PublicKeys[:1], Register, 0, registerbuf)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("tcp", network.Topology.Entry().MessageAddr)
+	if err != nil {
+		return nil, err
+	}
+	err = send(conn, Register, 0, registerOnion)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Client{
+		conn:          conn,
+		network:       network,
+		privateKey:    privateKey,
+		doctrineHome:  doctrineHome,
+		ui:            ui,
+		announcements: make(chan *announcement, MaxPendingAnnouncements),
+		outgoing:      make(chan []byte, MaxQueuedMessages),
+		invitations:   make(chan []byte, MaxQueuedInvitations),
+		publicKeys:    network.PublicKeys,
+		pending:       make(map[uint32][][]byte),
+		peerName:      "nobody",
+	}, nil
+}
+
+// Close hangs up on the entry server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// SetPeer starts talking to the owner of peerPublicKey.
+func (c *Client) SetPeer(name string, peerPublicKey PublicKey) error {
+	convo, err := NewConversation(c.network.Suite, c.privateKey, peerPublicKey)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.convo = convo
+	c.peerName = name
+	c.mu.Unlock()
+	c.updateStatus()
+	return nil
+}
+
+// Run answers every announced round and handles typed lines until lines
+// is closed, the user quits or the connection to the entry server breaks.
+func (c *Client) Run(lines <-chan string) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.readReplies()
+	}()
+	if c.LoadNetwork != nil {
+		ticker := time.NewTicker(NetworkDoctrineMaxAge)
+		defer ticker.Stop()
+		go c.refreshNetwork(ticker.C)
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok || c.handleLine(line) {
+				return nil
+			}
+		case a := <-c.announcements:
+			if time.Now().After(a.deadline) {
+				// too late, the server would reject it
+				continue
+			}
+			var err error
+			switch a.kind {
+			case BatchConvo:
+				err = c.sendRound(a.round)
+			case BatchDial:
+				err = c.sendDialRound(a.round)
+			}
+			if err != nil {
+				return err
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// handleLine queues a typed message or runs a command. It reports whether
+// the user asked to quit.
+func (c *Client) handleLine(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "/quit":
+		return true
+	case "/peer", "/call":
+		if len(fields) != 2 {
+			c.ui.Printf("usage: %s <public key file>", fields[0])
+			return false
+		}
+		suite, publicKey, err := ReadPublicKey(fields[1])
+		if err != nil {
+			c.ui.Printf("read publickey error: %s", err)
+			return false
+		}
+		if suite != c.network.Suite {
+			c.ui.Printf("%s is a %s key, the network runs %s", fields[1], suite.Name(), c.network.Suite.Name())
+			return false
+		}
+		if fields[0] == "/peer" {
+			err = c.SetPeer(filepath.Base(fields[1]), publicKey)
+		} else {
+			err = c.queueInvitation(publicKey)
+			if err == nil {
+				c.ui.Printf("invitation to %s goes out next dialing round", fields[1])
+			}
+		}
+		if err != nil {
+			c.ui.Printf("%s error: %s", fields[0], err)
+		}
+		return false
+	}
+
+	c.mu.Lock()
+	convo := c.convo
+	c.mu.Unlock()
+	if convo == nil {
+		c.ui.Printf("not talking to anyone, use /peer <file> first")
+		return false
+	}
+	for _, chunk := range splitMessage(line, SizeConvoMessage) {
+		select {
+		case c.outgoing <- chunk:
+		default:
+			c.ui.Printf("too many queued messages, dropped: %s", chunk)
+			return false
+		}
+	}
+	c.ui.Printf("me: %s", line)
+	return false
+}
+
+func (c *Client) queueInvitation(callee PublicKey) error {
+	exchange, err := InvitationFor(c.network.Suite, c.privateKey.Public(), callee)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.invitations <- exchange:
+		return nil
+	default:
+		return fmt.Errorf("too many queued invitations")
+	}
+}
+
+// sendRound sends our onion for round, real or not.
+func (c *Client) sendRound(round uint32) error {
+	c.mu.Lock()
+	convo := c.convo
+	c.round = round
+	c.mu.Unlock()
+
+	var exchange []byte
+	var err error
+	if convo == nil {
+		exchange, err = FakeExchange()
+	} else {
+		var message []byte
+		select {
+		case message = <-c.outgoing:
+		default:
+		}
+		exchange, err = convo.Seal(round, message)
+	}
+	if err != nil {
+		return err
+	}
+
+	onion, replyKeys, err := WrapOnion(c.network.Suite, c.keys(), BatchConvo, round, exchange)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.pending[round] = replyKeys
+	for r := range c.pending {
+		// the reply for these is not coming anymore
+		if r+MaxPendingReplies < round {
+			delete(c.pending, r)
+		}
+	}
+	c.mu.Unlock()
+	c.updateStatus()
+	return send(c.conn, BatchConvo, round, onion)
+}
+
+// sendDialRound sends our invitation for round, real or not.
+func (c *Client) sendDialRound(round uint32) error {
+	c.mu.Lock()
+	c.dialRound = round
+	c.mu.Unlock()
+
+	var exchange []byte
+	var err error
+	select {
+	case exchange = <-c.invitations:
+	default:
+		exchange, err = FakeInvitation(c.network.Suite)
+		if err != nil {
+			return err
+		}
+	}
+	onion, _, err := WrapOnion(c.network.Suite, c.keys(), BatchDial, round, exchange)
+	if err != nil {
+		return err
+	}
+	c.updateStatus()
+	return send(c.conn, BatchDial, round, onion)
+}
+
+// keys returns the public keys of the network as last fetched.
+func (c *Client) keys() []PublicKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.publicKeys
+}
+
+// RefreshNetwork fetches the network with LoadNetwork and seals onions
+// for its keys from now on. The network has to be the same chain, running
+// the same suite.
+func (c *Client) RefreshNetwork() error {
+	network, err := c.LoadNetwork()
+	if err != nil {
+		return err
+	}
+	if network.Suite != c.network.Suite || len(network.PublicKeys) != len(c.network.PublicKeys) {
+		return fmt.Errorf("the network changed from %d %s servers to %d %s servers, reconnect to use it",
+			len(c.network.PublicKeys), c.network.Suite.Name(), len(network.PublicKeys), network.Suite.Name())
+	}
+	c.mu.Lock()
+	for i, publicKey := range network.PublicKeys {
+		if !bytes.Equal(publicKey.Bytes(), c.publicKeys[i].Bytes()) {
+			c.ui.Printf("%s has a new key", network.Topology.Servers[i].Name)
+		}
+	}
+	c.publicKeys = network.PublicKeys
+	c.mu.Unlock()
+	return nil
+}
+
+// refreshNetwork calls RefreshNetwork on every tick.
+func (c *Client) refreshNetwork(tick <-chan time.Time) {
+	for range tick {
+		err := c.RefreshNetwork()
+		if err != nil {
+			c.ui.Printf("refresh network doctrine error: %s", err)
+		}
+	}
+}
+
+func (c *Client) updateStatus() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ui.SetStatus("round %d | dialing round %d | talking to %s | %d queued", c.round, c.dialRound, c.peerName, len(c.outgoing))
+}
+
+// readReplies handles everything the entry server pushes to us: round
+// announcements, the reply to our onion of every round and our invitation
+// bucket after every dialing round.
+func (c *Client) readReplies() error {
+	for {
+		typ, payload, err := ReadFrame(c.conn, MaxFrameSize)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case FrameAnnouncement:
+			if len(payload) != 1+SizeRound+SizeDeadline {
+				return fmt.Errorf("announcement of %d bytes from entry server", len(payload))
+			}
+			c.announcements <- &announcement{
+				kind:     payload[0],
+				round:    binary.BigEndian.Uint32(payload[1:]),
+				deadline: time.Unix(0, int64(binary.BigEndian.Uint64(payload[1+SizeRound:]))),
+			}
+		case FrameBucket:
+			_, _, invitations, err := ParseBatch(payload, InvitationSize(c.network.Suite))
+			if err != nil {
+				return err
+			}
+			c.openBucket(invitations)
+		case FrameReply:
+			_, round, replies, err := ParseBatch(payload, ReplySize(len(c.network.PublicKeys)))
+			if err != nil {
+				return err
+			}
+			if len(replies) != 1 {
+				return fmt.Errorf("%d replies for round %d from entry server", len(replies), round)
+			}
+			c.handleReply(round, replies[0])
+		default:
+			// a newer entry server may send things we do not know about
+			c.ui.Printf("ignored frame of type %d from entry server", typ)
+		}
+	}
+}
+
+// handleReply peels the reply to our onion of round and shows the message
+// in it, if any. Replies that do not open are rounds the peer did not
+// show up in, and empty ones are rounds the peer had nothing to say.
+func (c *Client) handleReply(round uint32, reply []byte) {
+	c.mu.Lock()
+	replyKeys, ok := c.pending[round]
+	delete(c.pending, round)
+	convo, peerName := c.convo, c.peerName
+	c.mu.Unlock()
+	if !ok {
+		c.ui.Printf("dropped reply for round %d, it came too late", round)
+		return
+	}
+	var err error
+	for _, replyKey := range replyKeys {
+		reply, err = OpenReply(c.network.Suite, replyKey, reply)
+		if err != nil {
+			c.ui.Printf("open reply error: %s", err)
+			return
+		}
+	}
+	if convo == nil {
+		return
+	}
+	msg, err := convo.Open(round, reply)
+	if err != nil || len(msg) == 0 {
+		return
+	}
+	c.ui.Printf("%s: %s", peerName, msg)
+}
+
+// send writes an onion for round of kind to the entry server.
+func send(conn net.Conn, kind byte, round uint32, onion []byte) error {
+	return WriteFrame(conn, FrameOnion, EncodeOnion(kind, round, onion))
+}
+
+// openBucket tries every invitation in our bucket and saves the public
+// key of whoever invited us to doctrineHome, ready to be used with /peer.
+func (c *Client) openBucket(invitations [][]byte) {
+	for _, invitation := range invitations {
+		caller, err := OpenInvitation(c.network.Suite, c.privateKey, invitation)
+		if err != nil {
+			continue
+		}
+		fingerprint := hex.EncodeToString(c.network.Suite.Hash(caller.Bytes())[:8])
+		path := filepath.Join(c.doctrineHome, "caller-"+fingerprint+".pem")
+		err = WritePublicKey(path, c.network.Suite, caller)
+		if err != nil {
+			c.ui.Printf("save caller publickey error: %s", err)
+			continue
+		}
+		c.ui.Printf("invitation from %s, talk back with /peer %s", fingerprint, path)
+	}
+}
+
+// splitMessage cuts line into pieces of at most size bytes without
+// splitting a character.
+func splitMessage(line string, size int) [][]byte {
+	var chunks [][]byte
+	msg := []byte(line)
+	for len(msg) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(msg[cut]) {
+			cut--
+		}
+		chunks = append(chunks, msg[:cut])
+		msg = msg[cut:]
+	}
+	return append(chunks, msg)
+}
@@ -0,0 +1,76 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+type testUI struct {
+	lines []string
+}
+
+func (ui *testUI) Printf(format string, args ...interface{}) {
+	ui.lines = append(ui.lines, fmt.Sprintf(format, args...))
+}
+
+func (ui *testUI) SetStatus(format string, args ...interface{}) {}
+
+func testNetwork(t *testing.T, suite CryptoSuite, servers int) *Network {
+	t.Helper()
+	network := &Network{Topology: &Topology{}, Suite: suite}
+	for i := 0; i < servers; i++ {
+		key, err := suite.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.Topology.Servers = append(network.Topology.Servers, &ServerInfo{Name: fmt.Sprintf("hop%d", i)})
+		network.PublicKeys = append(network.PublicKeys, key.Public())
+	}
+	return network
+}
+
+func TestClientRefreshNetwork(t *testing.T) {
+	old := testNetwork(t, X25519Suite, 3)
+	rotated := *old
+	rotated.PublicKeys = append([]PublicKey(nil), old.PublicKeys...)
+	key, err := X25519Suite.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated.PublicKeys[2] = key.Public()
+
+	ui := new(testUI)
+	next := &rotated
+	c := &Client{
+		network:    old,
+		publicKeys: old.PublicKeys,
+		ui:         ui,
+		LoadNetwork: func() (*Network, error) {
+			return next, nil
+		},
+	}
+	err = c.RefreshNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.keys()[2].Bytes(), key.Public().Bytes()) {
+		t.Fatal("onions still go to the old key")
+	}
+	if len(ui.lines) != 1 || ui.lines[0] != "hop2 has a new key" {
+		t.Fatalf("told the user %q", ui.lines)
+	}
+
+	// another chain needs a new connection
+	next = testNetwork(t, X25519Suite, 2)
+	if err := c.RefreshNetwork(); err == nil {
+		t.Fatal("took a network of another length")
+	}
+	next = testNetwork(t, SM2Suite, 3)
+	if err := c.RefreshNetwork(); err == nil {
+		t.Fatal("took a network of another suite")
+	}
+	if !bytes.Equal(c.keys()[2].Bytes(), key.Public().Bytes()) {
+		t.Fatal("keys changed after a refused network")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dojiao/SimpleVuvuzela"
+)
+
+var (
+	home         = flag.String("home", "", "directory the client keeps its keys in (default $HOME/.vuvuzela_client)")
+	topologyPath = flag.String("topology", "", "topology file (default topology.json in -home)")
+	chain        = flag.String("chain", "", "comma separated messageaddr/doctrineaddr list, overrides -topology")
+	peer         = flag.String("peer", "", "public key file of the peer to talk to")
+	refresh      = flag.Bool("refresh", false, "fetch the network doctrine again instead of using the cached one")
+	rootPath     = flag.String("root", "", "the operator's public key doctrines are signed with (default root.pem in -home)")
+	passphraseFd = flag.Int("passphrase-fd", -1, "read the passphrase of our private key from this file descriptor")
+	encryptKey   = flag.Bool("encrypt-key", false, "encrypt our private key stored in the clear with a passphrase")
+)
+
+func main() {
+	flag.Parse()
+
+	doctrineHome := *home
+	var err error
+	if doctrineHome == "" {
+		doctrineHome, err = vuvuzela.DefaultHome(vuvuzela.ClientHome)
+		if err != nil {
+			fmt.Printf("get user home error: %s\n", err)
+			return
+		}
+	}
+	vuvuzela.KeyPassphrase.Fd = *passphraseFd
+	if *encryptKey {
+		err = vuvuzela.EncryptKeys(doctrineHome)
+		if err != nil {
+			fmt.Printf("encrypt key error: %s\n", err)
+			return
+		}
+		fmt.Printf("! Encrypted the private key in %s.\n", doctrineHome)
+		return
+	}
+	if *topologyPath == "" {
+		*topologyPath = filepath.Join(doctrineHome, vuvuzela.TopologyFile)
+	}
+	topology, err := vuvuzela.LoadTopology(*topologyPath, *chain)
+	if err != nil {
+		fmt.Printf("load topology error: %s\n", err)
+		return
+	}
+	if *rootPath == "" {
+		*rootPath = filepath.Join(doctrineHome, vuvuzela.RootKeyFile)
+	}
+	root, err := vuvuzela.ReadRootKey(*rootPath)
+	if err != nil {
+		fmt.Printf("read root key error: %s\n", err)
+		fmt.Printf("get the operator's public key out of band and save it as %s\n", *rootPath)
+		return
+	}
+	err = vuvuzela.MakeHome(doctrineHome)
+	if err != nil {
+		fmt.Printf("Init Server Error: %s\n", err)
+		return
+	}
+	cachePath := filepath.Join(doctrineHome, vuvuzela.NetworkDoctrineFile)
+	network, err := vuvuzela.LoadNetwork(topology, root, cachePath, *refresh)
+	if err != nil {
+		fmt.Printf("load network doctrine error: %s\n", err)
+		return
+	}
+	fmt.Printf("the network promises conversations %s, with noise %s\n", network.Privacy, network.Noise)
+
+	// our key is made for whatever suite the network runs the first
+	// time we connect.
+	_, err = os.Stat(filepath.Join(doctrineHome, vuvuzela.PrivateKeyFile))
+	if os.IsNotExist(err) {
+		_, err = vuvuzela.WriteNewKey(doctrineHome, network.Suite)
+		if err != nil {
+			fmt.Printf("generate key error: %s\n", err)
+			return
+		}
+	}
+	suite, privateKey, err := vuvuzela.ReadPrivateKey(doctrineHome)
+	if err != nil {
+		fmt.Printf("read key pair error: %s\n", err)
+		return
+	}
+	if suite != network.Suite {
+		fmt.Printf("our key is a %s key, the network runs %s\n", suite.Name(), network.Suite.Name())
+		return
+	}
+	var peerPublicKey vuvuzela.PublicKey
+	if *peer != "" {
+		suite, peerPublicKey, err = vuvuzela.ReadPublicKey(*peer)
+		if err != nil {
+			fmt.Printf("read peer publickey error: %s\n", err)
+			return
+		}
+		if suite != network.Suite {
+			fmt.Printf("%s is a %s key, the network runs %s\n", *peer, suite.Name(), network.Suite.Name())
+			return
+		}
+	}
+
+	ui := newUI()
+	defer ui.Close()
+	client, err := vuvuzela.Dial(network, privateKey, doctrineHome, ui)
+	if err != nil {
+		ui.Printf("connect to entry server error: %s", err)
+		return
+	}
+	defer client.Close()
+	client.LoadNetwork = func() (*vuvuzela.Network, error) {
+		return vuvuzela.LoadNetwork(topology, root, cachePath, true)
+	}
+	if peerPublicKey != nil {
+		err = client.SetPeer(filepath.Base(*peer), peerPublicKey)
+		if err != nil {
+			ui.Printf("start conversation error: %s", err)
+			return
+		}
+	}
+	ui.Printf("type a message and press enter; /peer <file> to talk to someone else, /call <file> to invite someone, /quit to leave")
+	lines := make(chan string)
+	go ui.ReadLines(lines)
+	err = client.Run(lines)
+	if err != nil {
+		ui.Printf("connection to entry server lost: %s", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// UI is a small terminal chat interface: a conversation pane that
+// scrolls, a status line and an input line at the bottom. When stdout is
+// not a terminal it falls back to printing lines.
+type UI struct {
+	mu     sync.Mutex
+	out    io.Writer
+	tty    bool
+	rows   int
+	status string
+}
+
+func newUI() *UI {
+	ui := &UI{out: os.Stdout, rows: 24}
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		ui.tty = true
+	}
+	if rows, err := strconv.Atoi(os.Getenv("LINES")); err == nil && rows > 3 {
+		ui.rows = rows
+	}
+	if ui.tty {
+		// clear the screen and keep the last two rows out of the
+		// scrolling region for the status and input lines
+		fmt.Fprintf(ui.out, "\x1b[2J\x1b[1;%dr", ui.rows-2)
+		ui.drawStatus()
+		ui.drawPrompt()
+	}
+	return ui
+}
+
+// Printf adds a line to the conversation pane.
+func (ui *UI) Printf(format string, args ...interface{}) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	line := fmt.Sprintf(format, args...)
+	if !ui.tty {
+		fmt.Fprintln(ui.out, line)
+		return
+	}
+	fmt.Fprintf(ui.out, "\x1b7\x1b[%d;1H\n%s\x1b8", ui.rows-2, line)
+}
+
+// SetStatus replaces the status line.
+func (ui *UI) SetStatus(format string, args ...interface{}) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.status = fmt.Sprintf(format, args...)
+	if ui.tty {
+		ui.drawStatus()
+	}
+}
+
+// ReadLines sends every line typed on stdin to lines and closes it at EOF.
+func (ui *UI) ReadLines(lines chan<- string) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if ui.tty {
+			ui.mu.Lock()
+			ui.drawPrompt()
+			ui.mu.Unlock()
+		}
+		lines <- scanner.Text()
+	}
+	close(lines)
+}
+
+// Close gives the terminal its scrolling region back.
+func (ui *UI) Close() {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if ui.tty {
+		fmt.Fprintf(ui.out, "\x1b[r\x1b[%d;1H\n", ui.rows)
+	}
+}
+
+func (ui *UI) drawStatus() {
+	fmt.Fprintf(ui.out, "\x1b7\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m\x1b8", ui.rows-1, ui.status)
+}
+
+func (ui *UI) drawPrompt() {
+	fmt.Fprintf(ui.out, "\x1b[%d;1H\x1b[2K> ", ui.rows)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dojiao/SimpleVuvuzela"
+)
+
+var (
+	doinit    = flag.Bool("init", false, "create the root key pair")
+	force     = flag.Bool("force", false, "with -init, overwrite an existing root key without asking")
+	keep      = flag.Bool("no-overwrite", false, "with -init, keep an existing root key without asking")
+	home      = flag.String("home", "", "directory the root key is kept in (default $HOME/.vuvuzela_operator)")
+	suiteName = flag.String("suite", "sm2", "crypto suite of the root key with -init: sm2 or x25519")
+	sign      = flag.String("sign", "", "public key file of a server to sign a doctrine for")
+	addr      = flag.String("addr", "", "message address of the server, as in the topology")
+	role      = flag.String("role", "", "role of the server: entry, mix or last")
+	validity  = flag.Duration("valid", vuvuzela.DefaultDoctrineValidity, "how long the doctrine is valid")
+	version   = flag.Uint64("version", 1, "version of the doctrine, higher than any doctrine signed for the server before")
+	old       = flag.String("old", "", "with -sign, public key file of the key the server rotated away from")
+	oldUntil  = flag.String("old-until", "", "with -old, when the old key is retired (RFC 3339)")
+	network   = flag.Bool("network", false, "put together the network doctrine of the chain in -topology or -chain, for every server to sign")
+	epsilon   = flag.Float64("epsilon", vuvuzela.DefaultPrivacyBudget.Epsilon, "with -network, the epsilon of the differential privacy conversations get")
+	delta     = flag.Float64("delta", vuvuzela.DefaultPrivacyBudget.Delta, "with -network, the delta of the differential privacy conversations get")
+	rounds    = flag.Int("rounds", vuvuzela.DefaultPrivacyBudget.Rounds, "with -network, how many rounds a conversation gets the privacy for")
+	topology  = flag.String("topology", "", "topology file for -network")
+	chain     = flag.String("chain", "", "comma separated messageaddr/doctrineaddr list for -network, overrides -topology")
+	out       = flag.String("out", "", "where to write the doctrine (default doctrine.json, or network.json with -network)")
+	fd        = flag.Int("passphrase-fd", -1, "read the passphrase of the root key from this file descriptor")
+	encrypt   = flag.Bool("encrypt-key", false, "encrypt a root key stored in the clear with a passphrase")
+)
+
+func initOperator(operatorHome string) error {
+	mode, err := vuvuzela.OverwriteModeOf(*force, *keep)
+	if err != nil {
+		return err
+	}
+	suite, err := vuvuzela.SuiteByName(*suiteName)
+	if err != nil {
+		return err
+	}
+	err = vuvuzela.MakeHome(operatorHome)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("--> Generating root key pair.\n")
+	err = vuvuzela.Overwrite(filepath.Join(operatorHome, vuvuzela.PrivateKeyFile), mode)
+	if err != nil {
+		return err
+	}
+	_, err = vuvuzela.WriteNewKey(operatorHome, suite)
+	if err != nil {
+		return fmt.Errorf("generate key: %s", err)
+	}
+	fmt.Printf("! Hand %s to every server and client as %s.\n", filepath.Join(operatorHome, vuvuzela.PublicKeyFile), vuvuzela.RootKeyFile)
+	fmt.Printf("--> Done.\n")
+	return nil
+}
+
+func signDoctrine(operatorHome string) {
+	switch *role {
+	case vuvuzela.RoleEntry, vuvuzela.RoleMix, vuvuzela.RoleLast:
+	default:
+		fmt.Printf("unknown role %q\n", *role)
+		return
+	}
+	if *addr == "" {
+		fmt.Printf("-addr is missing\n")
+		return
+	}
+	suite, publicKey, err := vuvuzela.ReadPublicKey(*sign)
+	if err != nil {
+		fmt.Printf("read server publickey error: %s\n", err)
+		return
+	}
+	rootSuite, rootKey, err := vuvuzela.ReadPrivateKey(operatorHome)
+	if err != nil {
+		fmt.Printf("read root key error: %s\n", err)
+		return
+	}
+	if *out == "" {
+		*out = vuvuzela.DoctrineFile
+	}
+	doctrine := vuvuzela.NewDoctrine(suite, publicKey, *addr, *role, *validity, *version)
+	if *old != "" {
+		oldSuite, oldPublicKey, err := vuvuzela.ReadPublicKey(*old)
+		if err != nil {
+			fmt.Printf("read old publickey error: %s\n", err)
+			return
+		}
+		if oldSuite != suite {
+			fmt.Printf("old key is a %s key, the new one a %s key\n", oldSuite.Name(), suite.Name())
+			return
+		}
+		doctrine.OldUntil, err = time.Parse(time.RFC3339, *oldUntil)
+		if err != nil {
+			fmt.Printf("bad -old-until: %s\n", err)
+			return
+		}
+		doctrine.OldPublicKey = oldPublicKey.Bytes()
+	}
+	err = doctrine.Sign(rootSuite, rootKey)
+	if err != nil {
+		fmt.Printf("sign doctrine error: %s\n", err)
+		return
+	}
+	err = vuvuzela.WriteDoctrine(*out, doctrine)
+	if err != nil {
+		fmt.Printf("write doctrine error: %s\n", err)
+		return
+	}
+	fmt.Printf("! Wrote doctrine version %d for %s, valid until %s: %s\n", *version, *addr, doctrine.NotAfter.Format("2006-01-02 15:04"), *out)
+}
+
+// newNetworkDoctrine puts together the network doctrine of a running
+// chain. Every server then signs it with -sign-network, and it goes to the
+// servers that hand it out to clients.
+func newNetworkDoctrine(operatorHome string) {
+	t, err := vuvuzela.LoadTopology(*topology, *chain)
+	if err != nil {
+		fmt.Printf("load topology error: %s\n", err)
+		return
+	}
+	root, err := vuvuzela.ReadRootKey(filepath.Join(operatorHome, vuvuzela.PublicKeyFile))
+	if err != nil {
+		fmt.Printf("read root key error: %s\n", err)
+		return
+	}
+	privacy := vuvuzela.PrivacyBudget{Epsilon: *epsilon, Delta: *delta, Rounds: *rounds}
+	nd, err := vuvuzela.NewNetworkDoctrine(t, root, *version, privacy)
+	if err != nil {
+		fmt.Printf("network doctrine error: %s\n", err)
+		return
+	}
+	if *out == "" {
+		*out = vuvuzela.NetworkDoctrineFile
+	}
+	err = vuvuzela.WriteNetworkDoctrine(*out, nd)
+	if err != nil {
+		fmt.Printf("write network doctrine error: %s\n", err)
+		return
+	}
+	fmt.Printf("! Wrote network doctrine version %d of %d servers: %s\n", *version, len(nd.Servers), *out)
+	fmt.Printf("! Conversations get %s, with noise %s.\n", nd.Privacy, nd.Noise)
+	fmt.Printf("! Have every server sign it with -sign-network, then put it in the home of the entry server as %s.\n", vuvuzela.NetworkDoctrineFile)
+}
+
+func main() {
+	flag.Parse()
+
+	operatorHome := *home
+	if operatorHome == "" {
+		var err error
+		operatorHome, err = vuvuzela.DefaultHome(vuvuzela.OperatorHome)
+		if err != nil {
+			fmt.Printf("get user home error: %s\n", err)
+			return
+		}
+	}
+
+	vuvuzela.KeyPassphrase.Fd = *fd
+
+	switch {
+	case *doinit:
+		err := initOperator(operatorHome)
+		var exists *vuvuzela.ExistsError
+		if errors.As(err, &exists) {
+			fmt.Printf("! Kept the existing root key in %s.\n", operatorHome)
+		} else if err != nil {
+			fmt.Printf("Init Operator Error: %s\n", err)
+			os.Exit(1)
+		}
+	case *sign != "":
+		signDoctrine(operatorHome)
+	case *network:
+		newNetworkDoctrine(operatorHome)
+	case *encrypt:
+		err := vuvuzela.EncryptKeys(operatorHome)
+		if err != nil {
+			fmt.Printf("encrypt root key error: %s\n", err)
+			return
+		}
+		fmt.Printf("! Encrypted the root key in %s.\n", operatorHome)
+	default:
+		flag.Usage()
+	}
+}
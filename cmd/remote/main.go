@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dojiao/SimpleVuvuzela"
+)
+
+var (
+	doinit       = flag.Bool("init", false, "create config file")
+	force        = flag.Bool("force", false, "with -init, overwrite an existing key pair without asking")
+	noOverwrite  = flag.Bool("no-overwrite", false, "with -init, keep an existing key pair without asking")
+	home         = flag.String("home", "", "directory the server keeps its keys and doctrine in (default $HOME/.vuvuzela_remote)")
+	topologyPath = flag.String("topology", "", "topology file (default topology.json in -home)")
+	chain        = flag.String("chain", "", "comma separated messageaddr/doctrineaddr list, overrides -topology")
+	suiteName    = flag.String("suite", "sm2", "crypto suite of the new key with -init: sm2 or x25519")
+	operatorHome = flag.String("operator", "", "with -init, sign the doctrine with the operator key in this directory")
+	validity     = flag.Duration("valid", vuvuzela.DefaultDoctrineValidity, "how long a doctrine signed with -operator is valid")
+	version      = flag.Uint64("version", 1, "version of a doctrine signed with -operator")
+	signNetwork  = flag.String("sign-network", "", "network doctrine file to add our signature to")
+	rotate       = flag.Bool("rotate-key", false, "replace the key pair, the old key keeps working for -overlap")
+	overlap      = flag.Duration("overlap", vuvuzela.DefaultKeyOverlap, "how long the old key keeps working after -rotate-key")
+	passphraseFd = flag.Int("passphrase-fd", -1, "read the passphrase of the private keys from this file descriptor")
+	encryptKey   = flag.Bool("encrypt-key", false, "encrypt private keys stored in the clear with a passphrase")
+)
+
+func serverOptions() *vuvuzela.ServerOptions {
+	return &vuvuzela.ServerOptions{
+		TopologyPath: *topologyPath,
+		Chain:        *chain,
+		SuiteName:    *suiteName,
+		Force:        *force,
+		NoOverwrite:  *noOverwrite,
+		OperatorHome: *operatorHome,
+		Validity:     *validity,
+		Version:      *version,
+		Overlap:      *overlap,
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	doctrineHome := *home
+	if doctrineHome == "" {
+		var err error
+		doctrineHome, err = vuvuzela.DefaultHome(vuvuzela.RemoteHome)
+		if err != nil {
+			fmt.Printf("get user home error: %s\n", err)
+			return
+		}
+	}
+
+	vuvuzela.KeyPassphrase.Fd = *passphraseFd
+
+	if *doinit {
+		err := vuvuzela.InitServer(doctrineHome, vuvuzela.LastHop, serverOptions())
+		var exists *vuvuzela.ExistsError
+		if errors.As(err, &exists) {
+			fmt.Printf("! Kept the existing key pair in %s.\n", doctrineHome)
+		} else if err != nil {
+			fmt.Printf("Init Server Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *signNetwork != "" {
+		err := vuvuzela.SignNetworkDoctrine(doctrineHome, *signNetwork, nil)
+		if err != nil {
+			fmt.Printf("sign network doctrine error: %s\n", err)
+		}
+		return
+	}
+	if *rotate {
+		err := vuvuzela.RotateServerKey(doctrineHome, serverOptions())
+		if err != nil {
+			fmt.Printf("rotate key error: %s\n", err)
+		}
+		return
+	}
+	if *encryptKey {
+		err := vuvuzela.EncryptKeys(doctrineHome)
+		if err != nil {
+			fmt.Printf("encrypt key error: %s\n", err)
+			return
+		}
+		fmt.Printf("! Encrypted the private keys in %s.\n", doctrineHome)
+		return
+	}
+
+	topology, err := serverOptions().LoadTopology(doctrineHome)
+	if err != nil {
+		fmt.Printf("load topology error: %s\n", err)
+		return
+	}
+	keys, err := vuvuzela.LoadKeyRing(doctrineHome)
+	if err != nil {
+		fmt.Printf("read key pair error: %s\n", err)
+		return
+	}
+	go vuvuzela.ReloadOnHangup(keys, nil)
+	root, err := vuvuzela.ReadRootKey(filepath.Join(doctrineHome, vuvuzela.RootKeyFile))
+	if err != nil {
+		fmt.Printf("read root key error: %s\n", err)
+		return
+	}
+
+	go func() {
+		err := vuvuzela.Preach(doctrineHome, vuvuzela.ListenAddr(topology.Last().DoctrineAddr))
+		fmt.Printf("preach error: %s\n", err)
+	}()
+
+	server := &vuvuzela.LastServer{
+		Topology: topology,
+		Keys:     keys,
+		Root:     root,
+	}
+	err = server.ListenAndServe()
+	fmt.Printf("serve error: %s\n", err)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/dojiao/SimpleVuvuzela"
+)
+
+var (
+	doinit       = flag.Bool("init", false, "create config file")
+	force        = flag.Bool("force", false, "with -init, overwrite an existing key pair without asking")
+	noOverwrite  = flag.Bool("no-overwrite", false, "with -init, keep an existing key pair without asking")
+	home         = flag.String("home", "", "directory the server keeps its keys and doctrine in (default $HOME/.vuvuzela)")
+	topologyPath = flag.String("topology", "", "topology file (default topology.json in -home)")
+	chain        = flag.String("chain", "", "comma separated messageaddr/doctrineaddr list, overrides -topology")
+	suiteName    = flag.String("suite", "sm2", "crypto suite of the new key with -init: sm2 or x25519")
+	operatorHome = flag.String("operator", "", "with -init, sign the doctrine with the operator key in this directory")
+	validity     = flag.Duration("valid", vuvuzela.DefaultDoctrineValidity, "how long a doctrine signed with -operator is valid")
+	version      = flag.Uint64("version", 1, "version of a doctrine signed with -operator")
+	signNetwork  = flag.String("sign-network", "", "network doctrine file to add our signature to")
+	rotate       = flag.Bool("rotate-key", false, "replace the key pair, the old key keeps working for -overlap")
+	overlap      = flag.Duration("overlap", vuvuzela.DefaultKeyOverlap, "how long the old key keeps working after -rotate-key")
+	hop          = flag.Int("hop", 0, "position of this server in the topology, 0 is the entry server")
+	epsilon      = flag.Float64("epsilon", vuvuzela.DefaultPrivacyBudget.Epsilon, "epsilon of the differential privacy conversations get")
+	delta        = flag.Float64("delta", vuvuzela.DefaultPrivacyBudget.Delta, "delta of the differential privacy conversations get")
+	rounds       = flag.Int("rounds", vuvuzela.DefaultPrivacyBudget.Rounds, "how many rounds a conversation gets the privacy for")
+	noiseWorkers = flag.Int("noise-workers", runtime.NumCPU(), "how many goroutines wrap noise in onions")
+	noiseAhead   = flag.Int("noise-ahead", vuvuzela.DefaultNoiseAhead, "how many rounds ahead noise is wrapped")
+	passphraseFd = flag.Int("passphrase-fd", -1, "read the passphrase of the private keys from this file descriptor")
+	encryptKey   = flag.Bool("encrypt-key", false, "encrypt private keys stored in the clear with a passphrase")
+)
+
+func serverOptions() *vuvuzela.ServerOptions {
+	return &vuvuzela.ServerOptions{
+		TopologyPath: *topologyPath,
+		Chain:        *chain,
+		SuiteName:    *suiteName,
+		Force:        *force,
+		NoOverwrite:  *noOverwrite,
+		OperatorHome: *operatorHome,
+		Validity:     *validity,
+		Version:      *version,
+		Overlap:      *overlap,
+	}
+}
+
+func privacyBudget() vuvuzela.PrivacyBudget {
+	return vuvuzela.PrivacyBudget{Epsilon: *epsilon, Delta: *delta, Rounds: *rounds}
+}
+
+func main() {
+	flag.Parse()
+
+	doctrineHome := *home
+	if doctrineHome == "" {
+		var err error
+		doctrineHome, err = vuvuzela.DefaultHome(vuvuzela.ServerHome)
+		if err != nil {
+			fmt.Printf("get user home error: %s\n", err)
+			return
+		}
+	}
+
+	vuvuzela.KeyPassphrase.Fd = *passphraseFd
+
+	if *doinit {
+		err := vuvuzela.InitServer(doctrineHome, *hop, serverOptions())
+		var exists *vuvuzela.ExistsError
+		if errors.As(err, &exists) {
+			fmt.Printf("! Kept the existing key pair in %s.\n", doctrineHome)
+		} else if err != nil {
+			fmt.Printf("Init Server Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *signNetwork != "" {
+		privacy := privacyBudget()
+		err := vuvuzela.SignNetworkDoctrine(doctrineHome, *signNetwork, &privacy)
+		if err != nil {
+			fmt.Printf("sign network doctrine error: %s\n", err)
+		}
+		return
+	}
+	if *rotate {
+		err := vuvuzela.RotateServerKey(doctrineHome, serverOptions())
+		if err != nil {
+			fmt.Printf("rotate key error: %s\n", err)
+		}
+		return
+	}
+	if *encryptKey {
+		err := vuvuzela.EncryptKeys(doctrineHome)
+		if err != nil {
+			fmt.Printf("encrypt key error: %s\n", err)
+			return
+		}
+		fmt.Printf("! Encrypted the private keys in %s.\n", doctrineHome)
+		return
+	}
+
+	topology, err := serverOptions().LoadTopology(doctrineHome)
+	if err != nil {
+		fmt.Printf("load topology error: %s\n", err)
+		return
+	}
+	keys, err := vuvuzela.LoadKeyRing(doctrineHome)
+	if err != nil {
+		fmt.Printf("read key pair error: %s\n", err)
+		return
+	}
+	root, err := vuvuzela.ReadRootKey(filepath.Join(doctrineHome, vuvuzela.RootKeyFile))
+	if err != nil {
+		fmt.Printf("read root key error: %s\n", err)
+		return
+	}
+	server, err := vuvuzela.NewServer(topology, *hop, keys, root)
+	if err != nil {
+		fmt.Printf("start server error: %s\n", err)
+		return
+	}
+	go vuvuzela.ReloadOnHangup(keys, server.RefreshDownstream)
+	server.Noise, err = privacyBudget().Calibrate()
+	if err != nil {
+		fmt.Printf("noise error: %s\n", err)
+		return
+	}
+	fmt.Printf("conversations get %s\n", privacyBudget())
+	fmt.Printf("conversation noise: %s\n", server.Noise)
+	for _, pool := range []*vuvuzela.NoisePool{server.ConvoNoisePool, server.DialNoisePool} {
+		pool.Workers = *noiseWorkers
+		pool.Ahead = *noiseAhead
+	}
+
+	go func() {
+		err := vuvuzela.Preach(doctrineHome, vuvuzela.ListenAddr(topology.Servers[*hop].DoctrineAddr))
+		fmt.Printf("preach error: %s\n", err)
+	}()
+
+	err = server.ListenAndServe()
+	fmt.Printf("serve error: %s\n", err)
+}
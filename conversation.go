@@ -1,4 +1,4 @@
-package main
+package vuvuzela
 
 import (
 	"fmt"
@@ -7,61 +7,99 @@ import (
 )
 
 const (
-	EncryptLenStep       = 96
-	SizeSequence         = 1
-	SizeMessageBody      = 238
-	SizeEncryptedMessage = SizeSequence + SizeMessageBody + EncryptLenStep
-	SizeOnionMessage     = SizeSequence + SizeEncryptedMessage + EncryptLenStep
-	RoundDelay           = 800 * time.Millisecond
-	MsgPoolNum           = 10
+	RoundDelay       = 800 * time.Millisecond
+	exchangeDeadline = 30 * time.Second
 )
 
-var (
-	roundnum    = -1
-	msgpoolpool = make([]chan []byte, MsgPoolNum)
-	noise       = &Laplace{
-		Mu: 100,
-		B:  3.0,
+// envelope is a message waiting for its round, with the client connection
+// that should get the reply and the key to seal the reply with.
+type envelope struct {
+	msg      []byte
+	replyKey []byte
+	conn     net.Conn
+}
+
+// roundend mixes a closed conversation round and hands every client the
+// reply to the message it submitted.
+func (s *Server) roundend(r *Round) error {
+	envelopes := r.Messages()
+	batch := make([][]byte, len(envelopes))
+	for i, e := range envelopes {
+		batch[i] = e.msg
 	}
-)
 
-func dealMessage(msg []byte) {
-	msgpool := msgpoolpool[roundnum%MsgPoolNum]
-	msgpool <- msg
+	replies, err := s.mix(r.Number, batch)
+	if err != nil {
+		return err
+	}
+	for i, e := range envelopes {
+		go s.reply(e.conn, r.Number, e.replyKey, replies[i])
+	}
+	return nil
 }
 
-func roundstart() {
-	go roundend()
-	roundnum++
-	msgpool := make(chan []byte)
-	msgpoolpool[roundnum%MsgPoolNum] = msgpool
-	noisenum := noise.Uint32()
-	for noisenum != 1 {
-		noisenum--
-		generatenoise()
+// mix adds noise to batch, forwards it to the next hop in a random order
+// and returns the next hop's replies in the order of batch.
+func (s *Server) mix(round uint32, batch [][]byte) ([][]byte, error) {
+	noise, err := s.ConvoNoisePool.Take(round)
+	if err != nil {
+		return nil, err
 	}
-	generatenoise()
-}
+	all := make([][]byte, len(batch), len(batch)+len(noise))
+	copy(all, batch)
+	all = append(all, noise...)
 
-func generatenoise() {
-	noisebuf := make([]byte, SizeSequence+SizeMessageBody)
-	newnoise, err := destPublicKey.Encrypt(noisebuf)
+	perm, err := Shuffle(all)
 	if err != nil {
-		fmt.Printf("encrypt noise error: %s\n", err)
+		return nil, err
+	}
+	replies, err := s.exchange(round, all)
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) != len(all) {
+		return nil, fmt.Errorf("next hop sent %d replies for %d messages", len(replies), len(all))
 	}
-	msgpool := msgpoolpool[roundnum%MsgPoolNum]
-	msgpool <- newnoise
+	replies = Unshuffle(replies, perm)
+	return replies[:len(batch)], nil
 }
 
-func roundend() {
-	msgpool := msgpoolpool[roundnum%MsgPoolNum]
-	for msg := range msgpool {
-		conn, err := net.Dial("tcp", "101.200.37.186:20006")
-		//conn, err := net.Dial("tcp", "211.159.187.82:20006")
+// convoNoise draws the noise we add to a conversation round: exchanges
+// to dead drops of their own, and pairs of exchanges that meet in a dead
+// drop, so both counts the last server sees are covered.
+func (s *Server) convoNoise() ([][]byte, error) {
+	single, err := s.Noise.Single.Uint32()
+	if err != nil {
+		return nil, err
+	}
+	double, err := s.Noise.Double.Uint32()
+	if err != nil {
+		return nil, err
+	}
+	bodies := make([][]byte, 0, int(single)+2*int(double))
+	for i := uint32(0); i < single; i++ {
+		exchange, err := FakeExchange()
 		if err != nil {
-			fmt.Printf("send msg error: %s\n", err)
+			return nil, err
 		}
-		conn.Write(msg)
-		conn.Close()
+		bodies = append(bodies, exchange)
 	}
+	for i := uint32(0); i < double; i++ {
+		first, err := FakeExchange()
+		if err != nil {
+			return nil, err
+		}
+		second, err := FakeExchange()
+		if err != nil {
+			return nil, err
+		}
+		copy(second[:SizeDeadDrop], first[:SizeDeadDrop])
+		bodies = append(bodies, first, second)
+	}
+	return bodies, nil
+}
+
+// exchange sends a batch to the next hop and waits for its replies.
+func (s *Server) exchange(round uint32, batch [][]byte) ([][]byte, error) {
+	return s.next.Exchange(BatchConvo, round, batch, ReplySize(len(s.Topology.Servers)-s.Hop-1))
 }
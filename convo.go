@@ -0,0 +1,106 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	SizeDeadDrop     = 16
+	SizeNonce        = 12
+	SizeConvoMessage = SizeMessageBody - SizeDeadDrop - SizeNonce - SizeTag
+)
+
+// Conversation holds what two clients derive from their key pairs to talk
+// through dead drops: the shared secret their dead drops are derived from
+// and the keys each direction of the conversation is sealed with.
+type Conversation struct {
+	suite   CryptoSuite
+	secret  []byte
+	sendKey []byte
+	recvKey []byte
+}
+
+// NewConversation derives the conversation between the owner of
+// privateKey and the owner of peerPublicKey. Both sides derive the same
+// dead drops, with the send and receive keys swapped.
+func NewConversation(suite CryptoSuite, privateKey PrivateKey, peerPublicKey PublicKey) (*Conversation, error) {
+	secret, err := suite.SharedSecret(privateKey, peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	mine := append(append([]byte{}, secret...), privateKey.Public().Bytes()...)
+	peers := append(append([]byte{}, secret...), peerPublicKey.Bytes()...)
+
+	convo := new(Conversation)
+	convo.suite = suite
+	convo.secret = secret
+	convo.sendKey = suite.Hash(mine)[:suite.KeySize()]
+	convo.recvKey = suite.Hash(peers)[:suite.KeySize()]
+	return convo, nil
+}
+
+// deadDrop is where both sides of the conversation meet in round. It
+// changes every round so the last server cannot link rounds together.
+func (c *Conversation) deadDrop(round uint32) []byte {
+	buf := append([]byte("deaddrop"), c.secret...)
+	var roundbuf [SizeRound]byte
+	binary.BigEndian.PutUint32(roundbuf[:], round)
+	return c.suite.Hash(append(buf, roundbuf[:]...))[:SizeDeadDrop]
+}
+
+// Seal builds the exchange for message in round: the dead drop followed
+// by the message sealed for the peer.
+func (c *Conversation) Seal(round uint32, message []byte) ([]byte, error) {
+	if len(message) > SizeConvoMessage {
+		return nil, errors.New("message too long")
+	}
+	aead, err := c.suite.NewAEAD(c.sendKey)
+	if err != nil {
+		return nil, err
+	}
+	var msgbuf [SizeConvoMessage]byte
+	copy(msgbuf[:], message)
+
+	deadDrop := c.deadDrop(round)
+	exchange := make([]byte, SizeDeadDrop+SizeNonce, SizeMessageBody)
+	copy(exchange, deadDrop)
+	nonce := exchange[SizeDeadDrop:]
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(exchange, nonce, msgbuf[:], deadDrop), nil
+}
+
+// FakeExchange is the cover traffic sent in rounds we are not in a
+// conversation: a random dead drop and random bytes, which nobody on the
+// way can tell apart from a sealed message.
+func FakeExchange() ([]byte, error) {
+	exchange := make([]byte, SizeMessageBody)
+	_, err := io.ReadFull(rand.Reader, exchange)
+	return exchange, err
+}
+
+// Open returns the message in a reply from the dead drop of round. It
+// fails when the reply is not from the peer, e.g. the peer was not there
+// this round and the server handed back our own exchange.
+func (c *Conversation) Open(round uint32, reply []byte) ([]byte, error) {
+	deadDrop := c.deadDrop(round)
+	if len(reply) != SizeMessageBody || !bytes.Equal(reply[:SizeDeadDrop], deadDrop) {
+		return nil, errors.New("not from this conversation")
+	}
+	aead, err := c.suite.NewAEAD(c.recvKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := reply[SizeDeadDrop : SizeDeadDrop+SizeNonce]
+	msg, err := aead.Open(nil, nonce, reply[SizeDeadDrop+SizeNonce:], deadDrop)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(msg, "\x00"), nil
+}
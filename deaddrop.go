@@ -0,0 +1,43 @@
+package vuvuzela
+
+import (
+	"fmt"
+)
+
+// exchangeDeadDrops runs one round of the conversation protocol. Every
+// exchange starts with the dead drop it is addressed to; when exactly two
+// exchanges meet in a dead drop they are swapped, otherwise an exchange
+// comes back to its sender unchanged. Missing exchanges (noise or onions
+// that failed to open) get an empty reply.
+func exchangeDeadDrops(round uint32, exchanges [][]byte) [][]byte {
+	deadDrops := make(map[[SizeDeadDrop]byte][]int)
+	for i, ex := range exchanges {
+		if ex == nil {
+			continue
+		}
+		var id [SizeDeadDrop]byte
+		copy(id[:], ex[:SizeDeadDrop])
+		deadDrops[id] = append(deadDrops[id], i)
+	}
+
+	replies := make([][]byte, len(exchanges))
+	for i, ex := range exchanges {
+		if ex == nil {
+			replies[i] = make([]byte, SizeMessageBody)
+		} else {
+			replies[i] = ex
+		}
+	}
+	var single, double int
+	for _, drop := range deadDrops {
+		switch len(drop) {
+		case 1:
+			single++
+		case 2:
+			double++
+			replies[drop[0]], replies[drop[1]] = exchanges[drop[1]], exchanges[drop[0]]
+		}
+	}
+	fmt.Printf("round %d: %d onions, %d single dead drops, %d double dead drops\n", round, len(exchanges), single, double)
+	return replies
+}
@@ -0,0 +1,169 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	DialRoundDelay = 10 * time.Second
+	DialBuckets    = 16
+	SizeBucket     = 4
+)
+
+var (
+	// dialing rounds are far less frequent than conversation rounds and
+	// get their own noise.
+	dialNoise = &Laplace{
+		Mu: 50,
+		B:  2.0,
+	}
+	invitationAD = []byte("invitation")
+)
+
+// InvitationSize is the size of an invitation: the caller's public key
+// sealed for the callee.
+func InvitationSize(suite CryptoSuite) int {
+	return suite.PublicKeySize() + suite.LayerOverhead()
+}
+
+// DialExchangeSize is the size of what a client sends in a dialing round:
+// a bucket and an invitation.
+func DialExchangeSize(suite CryptoSuite) int {
+	return SizeBucket + InvitationSize(suite)
+}
+
+// BucketOf is the invitation bucket of the owner of publicKey.
+func BucketOf(suite CryptoSuite, publicKey PublicKey) uint32 {
+	return binary.BigEndian.Uint32(suite.Hash(publicKey.Bytes())) % DialBuckets
+}
+
+// InvitationFor builds an invitation carrying publicKey for the bucket of
+// callee. Only callee can open it.
+func InvitationFor(suite CryptoSuite, publicKey, callee PublicKey) ([]byte, error) {
+	invitation, _, err := suite.SealLayer(callee, invitationAD, publicKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	exchange := make([]byte, SizeMessageBody)
+	binary.BigEndian.PutUint32(exchange, BucketOf(suite, callee))
+	copy(exchange[SizeBucket:], invitation)
+	return exchange, nil
+}
+
+// FakeInvitation is the cover traffic sent in dialing rounds we are not
+// calling anyone: random bytes in a random bucket, laid out like a real
+// invitation.
+func FakeInvitation(suite CryptoSuite) ([]byte, error) {
+	exchange := make([]byte, SizeMessageBody)
+	_, err := io.ReadFull(rand.Reader, exchange[:DialExchangeSize(suite)])
+	if err != nil {
+		return nil, err
+	}
+	bucket := binary.BigEndian.Uint32(exchange) % DialBuckets
+	binary.BigEndian.PutUint32(exchange, bucket)
+	return exchange, nil
+}
+
+// OpenInvitation returns the public key of the caller in an invitation
+// from our bucket, or an error if the invitation is for someone else.
+func OpenInvitation(suite CryptoSuite, privateKey PrivateKey, invitation []byte) (PublicKey, error) {
+	buf, _, err := suite.OpenLayer(privateKey, invitationAD, invitation)
+	if err != nil {
+		return nil, err
+	}
+	return suite.ParsePublicKey(buf)
+}
+
+// dialroundend sends a closed dialing round down the chain and hands
+// every client the invitation bucket its public key falls in.
+func (s *Server) dialroundend(r *Round) error {
+	round := r.Number
+	var batch [][]byte
+	for _, e := range r.Messages() {
+		batch = append(batch, e.msg)
+	}
+	exchanges, err := s.mixDial(round, batch)
+	if err != nil {
+		return err
+	}
+
+	buckets := make(map[uint32][][]byte)
+	for _, ex := range exchanges {
+		bucket := binary.BigEndian.Uint32(ex[:SizeBucket])
+		buckets[bucket] = append(buckets[bucket], ex[SizeBucket:])
+	}
+
+	s.connLock.RLock()
+	defer s.connLock.RUnlock()
+	for conn, publicKey := range s.connMap {
+		bucket := BucketOf(s.Suite, publicKey)
+		go tell(conn, FrameBucket, EncodeBatch(BatchDial, round, buckets[bucket]))
+	}
+	return nil
+}
+
+// mixDial adds dialing noise to batch and forwards it to the next hop in
+// a random order. The last server answers with every invitation of the
+// round, each prefixed with its bucket.
+func (s *Server) mixDial(round uint32, batch [][]byte) ([][]byte, error) {
+	noise, err := s.DialNoisePool.Take(round)
+	if err != nil {
+		return nil, err
+	}
+	batch = append(batch, noise...)
+	_, err = Shuffle(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.next.Exchange(BatchDial, round, batch, DialExchangeSize(s.Suite))
+}
+
+// dialNoise draws the noise we add to a dialing round: invitations of
+// random bytes in random buckets, like the ones clients send when they
+// are not calling anyone.
+func (s *Server) dialNoise() ([][]byte, error) {
+	noisenum, err := dialNoise.Uint32()
+	if err != nil {
+		return nil, err
+	}
+	bodies := make([][]byte, noisenum)
+	for i := range bodies {
+		bodies[i], err = FakeInvitation(s.Suite)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bodies, nil
+}
+
+// hopDial peels our layer off every message of a dialing round, mixes
+// the batch down the chain and passes the published invitations back.
+func (s *Server) hopDial(link *hopLink, round uint32, onions [][]byte) {
+	var batch [][]byte
+	for _, onion := range onions {
+		inner, replyKey, err := s.Keys.OpenLayer(BatchDial, round, onion)
+		if err != nil || replayed(s.replays[BatchDial], round, replyKey, link.RemoteAddr()) {
+			continue
+		}
+		batch = append(batch, inner)
+	}
+
+	exchanges, err := s.mixDial(round, batch)
+	if err != nil {
+		fmt.Printf("mix dialing round error: %s\n", err)
+		err = link.WriteFailure(BatchDial, round, err)
+		if err != nil {
+			fmt.Println("write failure error:", err)
+		}
+		return
+	}
+	err = link.WriteBatch(FrameReplies, BatchDial, round, exchanges)
+	if err != nil {
+		fmt.Println("write invitations error:", err)
+	}
+}
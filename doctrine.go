@@ -1,125 +1,362 @@
-package main
+package vuvuzela
 
 import (
-	"crypto/rand"
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
-
-	"github.com/tjfoc/gmsm/sm2"
+	"strings"
+	"time"
 )
 
-var (
-	doctrineHome string
+// The role a server plays in the chain is part of its doctrine.
+const (
+	RoleEntry = "entry"
+	RoleMix   = "mix"
+	RoleLast  = "last"
 )
 
+// DefaultDoctrineValidity is how long a doctrine is valid for unless the
+// operator says otherwise.
+const DefaultDoctrineValidity = 30 * 24 * time.Hour
+
+// A doctrine is how a server tells the world its public key and the
+// crypto suite it runs. Doctrines are signed by the operator's root key,
+// which everyone pins out of band, over the key and everything else in
+// the doctrine. Doctrines without a suite run DefaultSuite.
 type Doctrine struct {
+	Suite     string `json:",omitempty"`
 	PublicKey []byte
-	Signature []byte
+	Addr      string
+	Role      string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Version goes up every time the operator signs a new doctrine for
+	// the server.
+	Version uint64
+	// OldPublicKey is the key the server rotated away from, which still
+	// opens onions until OldUntil.
+	OldPublicKey []byte    `json:",omitempty"`
+	OldUntil     time.Time `json:",omitempty"`
+	Signature    []byte
 }
 
-func parseDoctrine(doctrineBuf []byte) (*Doctrine, error) {
+// RootKey is the operator key doctrines are signed with.
+type RootKey struct {
+	Suite     CryptoSuite
+	PublicKey PublicKey
+}
+
+var doctrineContext = []byte("vuvuzela doctrine\n")
+
+func ParseDoctrine(doctrineBuf []byte) (*Doctrine, error) {
 	doctrine := new(Doctrine)
 	err := json.Unmarshal(doctrineBuf, doctrine)
 	return doctrine, err
 }
 
-func writeNewDoctrine() {
-	keypair, err := sm2.GenerateKey()
+// NewDoctrine makes an unsigned doctrine for publicKey, a key of suite,
+// of the server with role that takes messages at addr. It is valid from
+// now on for validity.
+func NewDoctrine(suite CryptoSuite, publicKey PublicKey, addr, role string, validity time.Duration, version uint64) *Doctrine {
+	now := time.Now()
+	return &Doctrine{
+		Suite:     suite.Name(),
+		PublicKey: publicKey.Bytes(),
+		Addr:      addr,
+		Role:      role,
+		NotBefore: now,
+		NotAfter:  now.Add(validity),
+		Version:   version,
+	}
+}
+
+// signedBytes is what the root key signs: every field of the doctrine but
+// the signature, length prefixed so no two doctrines sign the same bytes.
+func (d *Doctrine) signedBytes() []byte {
+	buf := bytes.NewBuffer(append([]byte{}, doctrineContext...))
+	for _, field := range [][]byte{[]byte(d.Suite), d.PublicKey, []byte(d.Addr), []byte(d.Role)} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	binary.Write(buf, binary.BigEndian, d.NotBefore.Unix())
+	binary.Write(buf, binary.BigEndian, d.NotAfter.Unix())
+	binary.Write(buf, binary.BigEndian, d.Version)
+	// doctrines from before key rotation sign the same bytes as before
+	if len(d.OldPublicKey) > 0 {
+		binary.Write(buf, binary.BigEndian, uint32(len(d.OldPublicKey)))
+		buf.Write(d.OldPublicKey)
+		binary.Write(buf, binary.BigEndian, d.OldUntil.Unix())
+	}
+	return buf.Bytes()
+}
+
+// Sign signs the doctrine with rootKey, the operator's private key of
+// rootSuite.
+func (d *Doctrine) Sign(rootSuite CryptoSuite, rootKey PrivateKey) error {
+	signature, err := rootSuite.Sign(rootKey, d.signedBytes())
 	if err != nil {
-		fmt.Printf("generate key error: %s\n", err)
+		return err
+	}
+	d.Signature = signature
+	return nil
+}
+
+// Verify returns the suite and the public key in the doctrine if the
+// doctrine is signed by root and valid at now.
+func (d *Doctrine) Verify(root *RootKey, now time.Time) (CryptoSuite, PublicKey, error) {
+	if len(d.Signature) == 0 {
+		return nil, nil, errors.New("doctrine is not signed")
 	}
-	publickey := &keypair.PublicKey
-	// 生成密钥文件
-	ok, err := sm2.WritePrivateKeytoPem(filepath.Join(doctrineHome, "priv.pem"), keypair, nil)
-	if ok != true {
-		fmt.Printf("generate key file error: %s\n", err)
-		return
+	if !root.Suite.Verify(root.PublicKey, d.signedBytes(), d.Signature) {
+		return nil, nil, errors.New("doctrine is not signed by the root key")
+	}
+	if now.Before(d.NotBefore) {
+		return nil, nil, fmt.Errorf("doctrine is not valid before %s", d.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(d.NotAfter) {
+		return nil, nil, fmt.Errorf("doctrine expired on %s", d.NotAfter.Format(time.RFC3339))
+	}
+	suite, err := SuiteByName(d.Suite)
+	if err != nil {
+		return nil, nil, err
 	}
+	publicKey, err := suite.ParsePublicKey(d.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return suite, publicKey, nil
+}
 
-	letter := []byte("thankyou")
-	signature, err := keypair.Sign(rand.Reader, letter, nil)
+// WriteDoctrine writes d to path.
+func WriteDoctrine(path string, d *Doctrine) error {
+	buf, err := json.Marshal(d)
 	if err != nil {
-		fmt.Printf("generate signature error: %s\n", err)
-		return
+		return err
 	}
+	return writeFileAtomic(path, buf, 0600)
+}
 
-	der, err := sm2.MarshalSm2PublicKey(publickey)
+// SignServerDoctrine signs a doctrine for the key in doctrineHome, as the
+// server at position hop of topology, with the operator key in
+// operatorHome. The doctrine is written to doctrineHome and the
+// operator's public key is pinned there as the root. It is for operators
+// that set up their servers themselves; others sign the server's public
+// key on their own machine.
+func SignServerDoctrine(doctrineHome, operatorHome string, topology *Topology, hop int, validity time.Duration, version uint64) error {
+	suite, publicKey, err := ReadPublicKey(filepath.Join(doctrineHome, PublicKeyFile))
 	if err != nil {
-		fmt.Printf("malshal publickey error: %s\n", err)
-		return
+		return err
 	}
-	doctrine := &Doctrine{
-		PublicKey: der,
-		Signature: signature,
+	server := topology.Servers[hop]
+	doctrine := NewDoctrine(suite, publicKey, server.MessageAddr, topology.RoleOf(hop), validity, version)
+	return signDoctrine(doctrineHome, operatorHome, doctrine)
+}
+
+// SignRotatedDoctrine signs the doctrine for the new key in doctrineHome
+// after RotateKey, with the operator key in operatorHome. It is the
+// server's doctrine with the new key, one version up, and it publishes
+// the old key until oldUntil.
+func SignRotatedDoctrine(doctrineHome, operatorHome string, old PublicKey, oldUntil time.Time, validity time.Duration) error {
+	data, err := ioutil.ReadFile(filepath.Join(doctrineHome, DoctrineFile))
+	if err != nil {
+		return err
+	}
+	previous, err := ParseDoctrine(data)
+	if err != nil {
+		return err
 	}
-	buf, err := json.Marshal(doctrine)
+	suite, publicKey, err := ReadPublicKey(filepath.Join(doctrineHome, PublicKeyFile))
 	if err != nil {
-		fmt.Printf("template error: %s\n", err)
-		return
+		return err
 	}
+	doctrine := NewDoctrine(suite, publicKey, previous.Addr, previous.Role, validity, previous.Version+1)
+	doctrine.OldPublicKey = old.Bytes()
+	doctrine.OldUntil = oldUntil
+	return signDoctrine(doctrineHome, operatorHome, doctrine)
+}
 
-	err = ioutil.WriteFile(filepath.Join(doctrineHome, "doctrine.json"), buf, 0600)
+// signDoctrine signs doctrine with the operator key in operatorHome,
+// writes it to doctrineHome and pins the operator's public key there as
+// the root.
+func signDoctrine(doctrineHome, operatorHome string, doctrine *Doctrine) error {
+	rootSuite, rootKey, _, err := readPrivateKeyFile(filepath.Join(operatorHome, PrivateKeyFile), RootPassphrase)
+	if err != nil {
+		return err
+	}
+	err = doctrine.Sign(rootSuite, rootKey)
+	if err != nil {
+		return err
+	}
+	err = WriteDoctrine(filepath.Join(doctrineHome, DoctrineFile), doctrine)
 	if err != nil {
-		fmt.Printf("write file error: %s\n", err)
-		return
+		return err
 	}
-	fmt.Printf("! Wrote new config file: %s\n", filepath.Join(doctrineHome, "doctrine.json"))
+	return WritePublicKey(filepath.Join(doctrineHome, RootKeyFile), rootSuite, rootKey.Public())
 }
 
-func overwrite(path string) bool {
+// OverwriteMode says what -init does about files that already exist.
+type OverwriteMode int
+
+const (
+	// OverwriteAsk asks on the terminal.
+	OverwriteAsk OverwriteMode = iota
+	// OverwriteForce overwrites without asking.
+	OverwriteForce
+	// OverwriteNever keeps what is there without asking.
+	OverwriteNever
+)
+
+// OverwriteModeOf is the mode the -force and -no-overwrite flags of -init
+// ask for.
+func OverwriteModeOf(force, noOverwrite bool) (OverwriteMode, error) {
+	switch {
+	case force && noOverwrite:
+		return 0, errors.New("-force and -no-overwrite do not go together")
+	case force:
+		return OverwriteForce, nil
+	case noOverwrite:
+		return OverwriteNever, nil
+	}
+	return OverwriteAsk, nil
+}
+
+// ExistsError is returned when a file is in the way of -init and may not
+// be overwritten.
+type ExistsError struct {
+	Path string
+}
+
+func (e *ExistsError) Error() string {
+	return e.Path + " already exists"
+}
+
+// Overwrite tells whether path may be written in mode: it returns nil if
+// there is nothing at path, and an *ExistsError if there is something that
+// has to stay. OverwriteAsk asks on standard input, and keeps the file
+// unless the answer is yes.
+func Overwrite(path string, mode OverwriteMode) error {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
-		return true
+		return nil
 	}
 	if err != nil {
-		fmt.Errorf("%s\n", err)
+		return err
+	}
+	switch mode {
+	case OverwriteForce:
+		return nil
+	case OverwriteNever:
+		return &ExistsError{Path: path}
 	}
 	fmt.Printf("%s already exists.\n", path)
 	fmt.Printf("Overwrite (y/N)? ")
-	var yesno [3]byte
-	n, err := os.Stdin.Read(yesno[:])
-	if err != nil {
-		fmt.Errorf("%s\n", err)
-	}
-	if n == 0 {
-		return false
+	answer, err := readLine(os.Stdin)
+	if err != nil && err != io.EOF {
+		return err
 	}
-	if yesno[0] != 'y' && yesno[0] != 'Y' {
-		return false
+	switch strings.ToLower(strings.TrimSpace(string(answer))) {
+	case "y", "yes":
+		return nil
 	}
-	return true
+	return &ExistsError{Path: path}
 }
 
-func preach() {
-	doctrinePath := filepath.Join(doctrineHome, "doctrine.json")
-	data, err := ioutil.ReadFile(doctrinePath)
+// Preach hands the doctrine in doctrineHome to everyone who connects to
+// addr, followed by the network doctrine if there is one in doctrineHome.
+// Both are read again for every connection, so a new doctrine after a key
+// rotation goes out without a restart.
+func Preach(doctrineHome, addr string) error {
+	data, network, err := readDoctrines(doctrineHome)
 	if err != nil {
-		fmt.Printf("read doctrine error: %s\n", err)
-		return
+		return err
 	}
-	doctrine := new(Doctrine)
-	err = json.Unmarshal(data, doctrine)
-	if err != nil {
-		fmt.Printf("parse doctrine error: %s\n", err)
-		return
+	if doctrine, _ := ParseDoctrine(data); time.Now().After(doctrine.NotAfter) {
+		fmt.Printf("doctrine expired on %s, nobody will take it\n", doctrine.NotAfter.Format(time.RFC3339))
 	}
 
-	l, err := net.Listen("tcp", ":2718")
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		fmt.Println("listen error:", err)
-		return
+		return err
 	}
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			fmt.Println("accept error:", err)
-			break
+			return err
+		}
+		newData, newNetwork, err := readDoctrines(doctrineHome)
+		if err != nil {
+			fmt.Printf("read doctrine error: %s, keep preaching the last one\n", err)
+		} else {
+			data, network = newData, newNetwork
+		}
+		WriteFrame(c, FrameDoctrine, data)
+		if network != nil {
+			WriteFrame(c, FrameNetworkDoctrine, network)
 		}
-		c.Write(data)
 		c.Close()
 	}
 }
+
+// readDoctrines reads the doctrine and the network doctrine, if any, in
+// doctrineHome.
+func readDoctrines(doctrineHome string) ([]byte, []byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(doctrineHome, DoctrineFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	doctrine, err := ParseDoctrine(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(doctrine.Signature) == 0 {
+		return nil, nil, errors.New("doctrine is not signed, have the operator sign it")
+	}
+	network, err := ioutil.ReadFile(filepath.Join(doctrineHome, NetworkDoctrineFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	return data, network, nil
+}
+
+// FetchDoctrine gets the doctrine of the server at addr.
+func FetchDoctrine(addr string) (*Doctrine, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	doctrineBuf, err := ExpectFrame(conn, FrameDoctrine, MaxDoctrineSize)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	return ParseDoctrine(doctrineBuf)
+}
+
+// FetchServerKey gets the doctrine of the server at position hop of
+// topology and returns the suite and public key in it, if root signed it
+// for the server's address and role and it has not expired.
+func FetchServerKey(root *RootKey, topology *Topology, hop int) (CryptoSuite, PublicKey, error) {
+	server := topology.Servers[hop]
+	doctrine, err := FetchDoctrine(server.DoctrineAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	suite, publicKey, err := doctrine.Verify(root, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	if doctrine.Addr != server.MessageAddr {
+		return nil, nil, fmt.Errorf("doctrine is for %s, not %s", doctrine.Addr, server.MessageAddr)
+	}
+	if role := topology.RoleOf(hop); doctrine.Role != role {
+		return nil, nil, fmt.Errorf("doctrine is for a %s server, not a %s server", doctrine.Role, role)
+	}
+	return suite, publicKey, nil
+}
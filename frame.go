@@ -0,0 +1,115 @@
+package vuvuzela
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Everything sent over a connection, between servers or between the
+// entry server and its clients, is wrapped in a frame:
+//
+//	[version 1][type 1][length 4][payload length]
+//
+// The length is big endian. Readers reassemble the whole frame with
+// io.ReadFull, so it does not matter how TCP cuts it up.
+const (
+	ProtocolVersion byte = 1
+	SizeFrameHeader      = 1 + 1 + 4
+	// MaxFrameSize bounds the frames between hops, which carry whole
+	// batches. Readers that do not need that much pass a smaller bound.
+	MaxFrameSize = 1 << 28
+	// MaxDoctrineSize bounds the doctrines a server hands out.
+	MaxDoctrineSize = 1 << 20
+)
+
+// Frame types.
+const (
+	// FrameOnion is an onion from a client to the entry server.
+	FrameOnion byte = iota + 1
+	// FrameAnnouncement tells a client a round is open.
+	FrameAnnouncement
+	// FrameReply is a batch holding the reply to a client's onion.
+	FrameReply
+	// FrameBucket is a batch holding a client's invitation bucket.
+	FrameBucket
+	// FrameBatch is a round forwarded to the next hop.
+	FrameBatch
+	// FrameReplies is the next hop's answer to a FrameBatch.
+	FrameReplies
+	// FrameDoctrine is a server's doctrine.
+	FrameDoctrine
+	// FrameNetworkDoctrine is the network doctrine, which a server hands
+	// out after its own doctrine if it has one.
+	FrameNetworkDoctrine
+	// FrameHello opens the link between two hops.
+	FrameHello
+	// FrameFailed is the next hop's answer to a FrameBatch it could not
+	// mix down the chain: the batch header and why.
+	FrameFailed
+)
+
+// FrameError is returned for a frame that cannot be read or is not the
+// type the reader expected.
+type FrameError struct {
+	Type   byte
+	Reason string
+}
+
+func (err FrameError) Error() string {
+	return fmt.Sprintf("frame of type %d: %s", err.Type, err.Reason)
+}
+
+// WriteFrame sends payload in a frame of type typ. The frame goes out in
+// a single Write, so frames written to the same connection from several
+// goroutines do not interleave.
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, SizeFrameHeader, SizeFrameHeader+len(payload))
+	buf[0] = ProtocolVersion
+	buf[1] = typ
+	binary.BigEndian.PutUint32(buf[2:], uint32(len(payload)))
+	buf = append(buf, payload...)
+	n, err := w.Write(buf)
+	if err == nil && n != len(buf) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// ReadFrame reads the next frame and returns its type and payload. A
+// frame whose header announces more than max bytes is refused before its
+// payload is read, so a peer cannot make us allocate more than that.
+func ReadFrame(r io.Reader, max int) (byte, []byte, error) {
+	header := make([]byte, SizeFrameHeader)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	typ := header[1]
+	if header[0] != ProtocolVersion {
+		return typ, nil, FrameError{typ, fmt.Sprintf("unsupported protocol version %d", header[0])}
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if int64(length) > int64(max) {
+		return typ, nil, FrameError{typ, fmt.Sprintf("%d bytes is too large", length)}
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return typ, nil, err
+	}
+	return typ, payload, nil
+}
+
+// ExpectFrame reads the next frame, of at most max bytes, and checks that
+// it has type typ.
+func ExpectFrame(r io.Reader, typ byte, max int) ([]byte, error) {
+	got, payload, err := ReadFrame(r, max)
+	if err != nil {
+		return nil, err
+	}
+	if got != typ {
+		return nil, FrameError{got, fmt.Sprintf("expected frame of type %d", typ)}
+	}
+	return payload, nil
+}
@@ -0,0 +1,34 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadFrameMax(t *testing.T) {
+	var buf bytes.Buffer
+	payload := bytes.Repeat([]byte{7}, 100)
+	if err := WriteFrame(&buf, FrameOnion, payload); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ExpectFrame(bytes.NewReader(buf.Bytes()), FrameOnion, len(payload))
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("frame of the largest size: got %d bytes, %v", len(got), err)
+	}
+
+	// the header alone has to be enough to refuse a frame
+	header := []byte{ProtocolVersion, FrameOnion, 0xff, 0xff, 0xff, 0xff}
+	r := io.MultiReader(bytes.NewReader(header), iotest.ErrReader(errors.New("read the payload")))
+	_, err = ExpectFrame(r, FrameOnion, len(payload))
+	if _, ok := err.(FrameError); !ok {
+		t.Fatalf("oversized frame: got %v", err)
+	}
+
+	_, err = ExpectFrame(bytes.NewReader(buf.Bytes()), FrameOnion, len(payload)-1)
+	if _, ok := err.(FrameError); !ok {
+		t.Fatalf("frame one byte too large: got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/dojiao/SimpleVuvuzela
+
+go 1.20
+
+require (
+	github.com/tjfoc/gmsm v1.3.2
+	golang.org/x/crypto v0.9.0
+)
+
+require golang.org/x/sys v0.8.0 // indirect
@@ -0,0 +1,437 @@
+package vuvuzela
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Servers next to each other in the chain talk over one long lived
+// connection, which the previous hop opens. It starts with a hello each
+// way:
+//
+//	previous hop: FrameHello [nonce sealed for the next hop][signature]
+//	next hop:     FrameHello [empty, sealed]
+//
+// The previous hop seals a random nonce for the key of the next hop like
+// an onion layer, and signs it with its own key. The key of that layer is
+// known to the two servers only, and every frame after the hello is sealed
+// with it: the next hop knows the batches come from the previous hop, and
+// the previous hop knows the replies come from the next hop. Batches and
+// their replies are matched up by kind and round, so rounds can overlap on
+// the one connection. A hop that cannot get a round through the rest of
+// the chain answers with a FrameFailed instead of replies, so the failure
+// reaches the entry server right away.
+
+var hopLinkContext = []byte("vuvuzela hop link\n")
+
+const (
+	sizeHelloNonce = 32
+	// maxHelloSize leaves room for the sealed nonce and a signature of
+	// any suite.
+	maxHelloSize     = 1 << 12
+	linkDialTimeout  = 5 * time.Second
+	handshakeTimeout = 10 * time.Second
+	linkMinBackoff   = 100 * time.Millisecond
+	linkMaxBackoff   = 10 * time.Second
+)
+
+// The direction of a frame on a link is part of its nonce, so frames
+// cannot be reflected back to their sender.
+const (
+	linkDown byte = 0
+	linkUp   byte = 1
+)
+
+// NextHopError is returned for a round that could not be sent down the
+// chain because the next hop is unavailable.
+type NextHopError struct {
+	Addr string
+	Err  error
+	// RetryIn is how long until we try to reach the next hop again.
+	RetryIn time.Duration
+}
+
+func (e *NextHopError) Error() string {
+	if e.RetryIn > 0 {
+		return fmt.Sprintf("next hop %s is unavailable: %s (next attempt in %s)", e.Addr, e.Err, e.RetryIn.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("next hop %s is unavailable: %s", e.Addr, e.Err)
+}
+
+// hopLink is an authenticated connection between two hops.
+type hopLink struct {
+	conn net.Conn
+	aead cipher.AEAD
+	// dir is the direction of the frames we send.
+	dir byte
+
+	wmu      sync.Mutex
+	sent     uint64
+	received uint64
+}
+
+func newHopLink(conn net.Conn, suite CryptoSuite, key []byte, dir byte) (*hopLink, error) {
+	aead, err := suite.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &hopLink{conn: conn, aead: aead, dir: dir}, nil
+}
+
+func (l *hopLink) nonce(dir byte, n uint64) []byte {
+	nonce := make([]byte, l.aead.NonceSize())
+	nonce[0] = dir
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// writeFrame seals payload and sends it in a frame of type typ. It is
+// safe to call from several goroutines.
+func (l *hopLink) writeFrame(typ byte, payload []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	sealed := l.aead.Seal(nil, l.nonce(l.dir, l.sent), payload, []byte{typ})
+	l.sent++
+	return WriteFrame(l.conn, typ, sealed)
+}
+
+// readFrame reads the next frame, which must have type typ, and opens it.
+// Only one goroutine may read from a link.
+func (l *hopLink) readFrame(typ byte) ([]byte, error) {
+	got, payload, err := l.readNext()
+	if err != nil {
+		return nil, err
+	}
+	if got != typ {
+		return nil, FrameError{got, fmt.Sprintf("expected frame of type %d", typ)}
+	}
+	return payload, nil
+}
+
+// readNext reads the next frame, whatever its type, and opens it.
+func (l *hopLink) readNext() (byte, []byte, error) {
+	typ, sealed, err := ReadFrame(l.conn, MaxFrameSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	payload, err := l.aead.Open(nil, l.nonce(l.dir^1, l.received), sealed, []byte{typ})
+	if err != nil {
+		return 0, nil, errors.New("frame is not sealed for this link")
+	}
+	l.received++
+	return typ, payload, nil
+}
+
+// WriteBatch sends a batch in a frame of type typ.
+func (l *hopLink) WriteBatch(typ, kind byte, round uint32, msgs [][]byte) error {
+	return l.writeFrame(typ, EncodeBatch(kind, round, msgs))
+}
+
+// ReadBatch reads a batch sent by WriteBatch in a frame of type typ whose
+// messages are size bytes long.
+func (l *hopLink) ReadBatch(typ byte, size int) (byte, uint32, [][]byte, error) {
+	payload, err := l.readFrame(typ)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return ParseBatch(payload, size)
+}
+
+// WriteFailure tells the previous hop that round of kind did not make it
+// down the chain, and why.
+func (l *hopLink) WriteFailure(kind byte, round uint32, reason error) error {
+	payload := EncodeBatch(kind, round, nil)
+	return l.writeFrame(FrameFailed, append(payload, reason.Error()...))
+}
+
+func (l *hopLink) RemoteAddr() net.Addr {
+	return l.conn.RemoteAddr()
+}
+
+func (l *hopLink) Close() error {
+	return l.conn.Close()
+}
+
+// helloAD binds the hello to the link from hop to the hop after it.
+func helloAD(topology *Topology, hop int) []byte {
+	ad := append([]byte{}, hopLinkContext...)
+	ad = append(ad, topology.Servers[hop].MessageAddr...)
+	ad = append(ad, '\n')
+	return append(ad, topology.Servers[hop+1].MessageAddr...)
+}
+
+// dialHop opens the link from hop to the next hop, whose public key is
+// next.
+func dialHop(topology *Topology, hop int, keys *KeyRing, next PublicKey) (*hopLink, error) {
+	conn, err := net.DialTimeout("tcp", topology.Servers[hop+1].MessageAddr, linkDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	link, err := helloNextHop(conn, topology, hop, keys, next)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return link, nil
+}
+
+func helloNextHop(conn net.Conn, topology *Topology, hop int, keys *KeyRing, next PublicKey) (*hopLink, error) {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, sizeHelloNonce)
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	ad := helloAD(topology, hop)
+	sealed, key, err := keys.Suite.SealLayer(next, ad, nonce)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := keys.Suite.Sign(keys.Current(), append(ad, sealed...))
+	if err != nil {
+		return nil, err
+	}
+	err = WriteFrame(conn, FrameHello, append(sealed, signature...))
+	if err != nil {
+		return nil, err
+	}
+	link, err := newHopLink(conn, keys.Suite, key, linkDown)
+	if err != nil {
+		return nil, err
+	}
+	_, err = link.readFrame(FrameHello)
+	if err != nil {
+		return nil, fmt.Errorf("no hello back: %s", err)
+	}
+	return link, conn.SetDeadline(time.Time{})
+}
+
+// acceptHop takes the link the previous hop opens to hop, and checks it
+// against the key in the previous hop's doctrine.
+func acceptHop(conn net.Conn, topology *Topology, hop int, keys *KeyRing, root *RootKey) (*hopLink, error) {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := ExpectFrame(conn, FrameHello, maxHelloSize)
+	if err != nil {
+		return nil, err
+	}
+	size := sizeHelloNonce + keys.Suite.LayerOverhead()
+	if len(payload) <= size {
+		return nil, errors.New("hello too short")
+	}
+	sealed, signature := payload[:size], payload[size:]
+
+	previous := topology.Servers[hop-1]
+	suite, publicKey, err := FetchServerKey(root, topology, hop-1)
+	if err != nil {
+		return nil, fmt.Errorf("fetch publickey of %s: %s", previous.Name, err)
+	}
+	if suite != keys.Suite {
+		return nil, fmt.Errorf("%s runs crypto suite %s, we run %s", previous.Name, suite.Name(), keys.Suite.Name())
+	}
+	ad := helloAD(topology, hop-1)
+	if !suite.Verify(publicKey, append(ad, sealed...), signature) {
+		return nil, fmt.Errorf("hello is not signed by %s", previous.Name)
+	}
+	_, key, err := keys.Open(ad, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("open hello: %s", err)
+	}
+	link, err := newHopLink(conn, suite, key, linkUp)
+	if err != nil {
+		return nil, err
+	}
+	err = link.writeFrame(FrameHello, nil)
+	if err != nil {
+		return nil, err
+	}
+	return link, conn.SetDeadline(time.Time{})
+}
+
+// nextHopLink is the link of a server to the next hop. It is opened when
+// the first batch goes out, and opened again after it breaks, backing off
+// while the next hop cannot be reached.
+type nextHopLink struct {
+	topology  *Topology
+	hop       int
+	keys      *KeyRing
+	publicKey PublicKey
+
+	mu      sync.Mutex
+	link    *hopLink
+	pending map[batchID]*pendingBatch
+	backoff time.Duration
+	retryAt time.Time
+	lastErr error
+}
+
+type batchID struct {
+	kind  byte
+	round uint32
+}
+
+// pendingBatch is a batch waiting for its replies, which are there when
+// done is closed.
+type pendingBatch struct {
+	size    int
+	replies [][]byte
+	err     error
+	done    chan struct{}
+}
+
+func newNextHopLink(topology *Topology, hop int, keys *KeyRing, publicKey PublicKey) *nextHopLink {
+	return &nextHopLink{
+		topology:  topology,
+		hop:       hop,
+		keys:      keys,
+		publicKey: publicKey,
+		pending:   make(map[batchID]*pendingBatch),
+	}
+}
+
+// SetKey greets the next hop with publicKey from the next link on, after
+// it rotated its key. An open link stays: its key does not change.
+func (h *nextHopLink) SetKey(publicKey PublicKey) {
+	h.mu.Lock()
+	h.publicKey = publicKey
+	h.mu.Unlock()
+}
+
+func (h *nextHopLink) addr() string {
+	return h.topology.Servers[h.hop+1].MessageAddr
+}
+
+// Exchange sends a round of kind to the next hop and waits for its
+// replies, whose messages are size bytes long.
+func (h *nextHopLink) Exchange(kind byte, round uint32, msgs [][]byte, size int) ([][]byte, error) {
+	id := batchID{kind, round}
+	var p *pendingBatch
+	// a link that broke while it was idle may only show on the first
+	// write, so a failed write gets one more try on a new link
+	for attempt := 0; ; attempt++ {
+		link, err := h.connect()
+		if err != nil {
+			return nil, err
+		}
+		p = &pendingBatch{size: size, done: make(chan struct{})}
+		h.mu.Lock()
+		h.pending[id] = p
+		h.mu.Unlock()
+		err = link.WriteBatch(FrameBatch, kind, round, msgs)
+		if err == nil {
+			break
+		}
+		h.fail(link, err)
+		if attempt > 0 {
+			return nil, &NextHopError{Addr: h.addr(), Err: err}
+		}
+	}
+
+	timer := time.NewTimer(exchangeDeadline)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		return p.replies, p.err
+	case <-timer.C:
+		h.mu.Lock()
+		if h.pending[id] == p {
+			delete(h.pending, id)
+		}
+		h.mu.Unlock()
+		return nil, fmt.Errorf("next hop did not answer round %d within %s", round, exchangeDeadline)
+	}
+}
+
+// connect returns the link to the next hop, opening it if there is none
+// and we are not backing off.
+func (h *nextHopLink) connect() (*hopLink, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.link != nil {
+		return h.link, nil
+	}
+	if wait := time.Until(h.retryAt); wait > 0 {
+		return nil, &NextHopError{Addr: h.addr(), Err: h.lastErr, RetryIn: wait}
+	}
+	link, err := dialHop(h.topology, h.hop, h.keys, h.publicKey)
+	if err != nil {
+		h.backoff *= 2
+		if h.backoff < linkMinBackoff {
+			h.backoff = linkMinBackoff
+		} else if h.backoff > linkMaxBackoff {
+			h.backoff = linkMaxBackoff
+		}
+		h.retryAt = time.Now().Add(h.backoff)
+		h.lastErr = err
+		return nil, &NextHopError{Addr: h.addr(), Err: err, RetryIn: h.backoff}
+	}
+	h.backoff = 0
+	h.link = link
+	fmt.Printf("connected to next hop %s\n", h.addr())
+	go h.readReplies(link)
+	return link, nil
+}
+
+// readReplies hands the replies that come in on link, or the news that
+// the round failed further down the chain, to the batches waiting for
+// them, until the link breaks.
+func (h *nextHopLink) readReplies(link *hopLink) {
+	for {
+		typ, payload, err := link.readNext()
+		if err == nil && typ != FrameReplies && typ != FrameFailed {
+			err = FrameError{typ, "expected replies"}
+		}
+		if err == nil && len(payload) < SizeBatchHeader {
+			err = errors.New("replies too short")
+		}
+		if err != nil {
+			h.fail(link, err)
+			return
+		}
+		id := batchID{payload[0], binary.BigEndian.Uint32(payload[1:])}
+		h.mu.Lock()
+		p := h.pending[id]
+		delete(h.pending, id)
+		h.mu.Unlock()
+		if p == nil {
+			fmt.Printf("replies to batch %d of round %d came too late\n", id.kind, id.round)
+			continue
+		}
+		if typ == FrameFailed {
+			reason := string(payload[SizeBatchHeader:])
+			p.err = &NextHopError{Addr: h.addr(), Err: fmt.Errorf("round %d failed down the chain: %s", id.round, reason)}
+		} else {
+			_, _, p.replies, p.err = ParseBatch(payload, p.size)
+		}
+		close(p.done)
+	}
+}
+
+// fail closes link after err, and fails every batch waiting on it.
+func (h *nextHopLink) fail(link *hopLink, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.link != link {
+		return
+	}
+	h.link = nil
+	link.Close()
+	fmt.Printf("lost next hop %s: %s\n", h.addr(), err)
+	for id, p := range h.pending {
+		p.err = &NextHopError{Addr: h.addr(), Err: err}
+		close(p.done)
+		delete(h.pending, id)
+	}
+}
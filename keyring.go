@@ -0,0 +1,209 @@
+package vuvuzela
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A server keeps the key pair it rotated away from under these names
+// until the key is retired.
+const (
+	OldPrivateKeyFile = "priv.old.pem"
+	OldPublicKeyFile  = "pub.old.pem"
+)
+
+// DefaultKeyOverlap is how long a rotated key keeps opening onions by
+// default. It has to leave the operator time to get the new doctrine
+// into the network doctrine, and clients time to pick that up.
+const DefaultKeyOverlap = 24 * time.Hour
+
+// MinKeyOverlap is the shortest overlap RotateKey takes. The operator
+// needs time to get the new doctrine into the network doctrine, and
+// clients then fetch it within NetworkDoctrineMaxAge; servers pick up the
+// new key within DownstreamRefresh.
+const MinKeyOverlap = 2 * NetworkDoctrineMaxAge
+
+// retireHeader is the PEM header of the old private key that says when it
+// is retired.
+const retireHeader = "Retire-After"
+
+// KeyRing is a server's private key, and during a key rotation the key it
+// rotated away from. Onions that do not open with the current key are
+// tried with the old one until it is retired, so clients that still use
+// the old public key keep working. At retirement the old key is
+// forgotten and deleted from disk: once it is gone, traffic sealed for it
+// cannot be opened anymore by anyone who gets hold of the server.
+type KeyRing struct {
+	Suite CryptoSuite
+
+	doctrineHome string
+
+	mu       sync.RWMutex
+	current  PrivateKey
+	old      PrivateKey
+	oldUntil time.Time
+	timer    *time.Timer
+}
+
+// LoadKeyRing reads the keys in doctrineHome.
+func LoadKeyRing(doctrineHome string) (*KeyRing, error) {
+	k := &KeyRing{doctrineHome: doctrineHome}
+	err := k.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the keys in the ring's home again, after a rotation. The
+// suite of a ring does not change.
+func (k *KeyRing) Reload() error {
+	suite, current, err := ReadPrivateKey(k.doctrineHome)
+	if err != nil {
+		return err
+	}
+	if k.Suite != nil && suite != k.Suite {
+		return fmt.Errorf("new key is a %s key, the server runs %s", suite.Name(), k.Suite.Name())
+	}
+	old, oldUntil, err := readOldPrivateKey(k.doctrineHome, suite)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.Suite = suite
+	k.current = current
+	k.old = old
+	k.oldUntil = oldUntil
+	if k.timer != nil {
+		k.timer.Stop()
+		k.timer = nil
+	}
+	if old != nil {
+		fmt.Printf("old key opens onions until %s\n", oldUntil.Format(time.RFC3339))
+		k.timer = time.AfterFunc(time.Until(oldUntil), k.retire)
+	}
+	return nil
+}
+
+// Current is the key the server's doctrine publishes.
+func (k *KeyRing) Current() PrivateKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// OpenLayer opens our layer of an onion for round of kind with the
+// current key, or with the old key while it is not retired.
+func (k *KeyRing) OpenLayer(kind byte, round uint32, onion []byte) ([]byte, []byte, error) {
+	return k.Open(onionHeader(kind, round), onion)
+}
+
+// Open opens a layer sealed for us with ad, with the current key or with
+// the old key while it is not retired.
+func (k *KeyRing) Open(ad, sealed []byte) ([]byte, []byte, error) {
+	k.mu.RLock()
+	current, old, oldUntil := k.current, k.old, k.oldUntil
+	k.mu.RUnlock()
+	inner, replyKey, err := k.Suite.OpenLayer(current, ad, sealed)
+	if err != nil && old != nil && time.Now().Before(oldUntil) {
+		var oldErr error
+		inner, replyKey, oldErr = k.Suite.OpenLayer(old, ad, sealed)
+		if oldErr == nil {
+			err = nil
+		}
+	}
+	return inner, replyKey, err
+}
+
+// retire forgets the old key and deletes it.
+func (k *KeyRing) retire() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.old == nil || time.Now().Before(k.oldUntil) {
+		return
+	}
+	k.old = nil
+	os.Remove(filepath.Join(k.doctrineHome, OldPublicKeyFile))
+	err := os.Remove(filepath.Join(k.doctrineHome, OldPrivateKeyFile))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("delete retired key error: %s\n", err)
+		return
+	}
+	fmt.Printf("retired the old key\n")
+}
+
+// readOldPrivateKey reads the old key in doctrineHome, if there is one
+// that is not retired yet. Old keys found past their retirement are
+// deleted on the spot.
+func readOldPrivateKey(doctrineHome string, suite CryptoSuite) (PrivateKey, time.Time, error) {
+	path := filepath.Join(doctrineHome, OldPrivateKeyFile)
+	block, err := readPEM(path)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// the header is in the clear, so a retired key is deleted without
+	// asking for its passphrase
+	until, err := time.Parse(time.RFC3339, block.Headers[retireHeader])
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %s", path, err)
+	}
+	if time.Now().After(until) {
+		os.Remove(filepath.Join(doctrineHome, OldPublicKeyFile))
+		return nil, time.Time{}, os.Remove(path)
+	}
+	oldSuite, old, _, err := readPrivateKeyFile(path, KeyPassphrase)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if oldSuite != suite {
+		return nil, time.Time{}, fmt.Errorf("%s is not a %s key", path, suite.Name())
+	}
+	return old, until, nil
+}
+
+// RotateKey replaces the key pair in doctrineHome with a new one of the
+// same suite. The old private key is kept until overlap has passed, and
+// returned with its public key so the new doctrine can publish both.
+// There can be only one rotation going on at a time, and the overlap has
+// to give the servers before us and the clients time to pick up the new
+// key, see MinKeyOverlap.
+func RotateKey(doctrineHome string, overlap time.Duration) (PrivateKey, PublicKey, time.Time, error) {
+	if overlap < MinKeyOverlap {
+		return nil, nil, time.Time{}, fmt.Errorf("overlap has to be at least %s", MinKeyOverlap)
+	}
+	suite, current, err := ReadPrivateKey(doctrineHome)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	old, oldUntil, err := readOldPrivateKey(doctrineHome, suite)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	if old != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("the last rotation overlaps until %s", oldUntil.Format(time.RFC3339))
+	}
+
+	until := time.Now().Add(overlap)
+	headers := map[string]string{retireHeader: until.Format(time.RFC3339)}
+	err = writePrivateKeyFile(filepath.Join(doctrineHome, OldPrivateKeyFile), suite, current, headers)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	err = WritePublicKey(filepath.Join(doctrineHome, OldPublicKeyFile), suite, current.Public())
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	privateKey, err := WriteNewKey(doctrineHome, suite)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	return privateKey, current.Public(), until, nil
+}
@@ -0,0 +1,278 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// Everything a server or client keeps lives in its home directory under
+// these names.
+const (
+	PrivateKeyFile = "priv.pem"
+	PublicKeyFile  = "pub.pem"
+	DoctrineFile   = "doctrine.json"
+	TopologyFile   = "topology.json"
+	// RootKeyFile is the operator's public key, pinned out of band.
+	RootKeyFile = "root.pem"
+)
+
+// Default home directories, relative to the user's home.
+const (
+	ServerHome = ".vuvuzela"
+	RemoteHome = ".vuvuzela_remote"
+	ClientHome = ".vuvuzela_client"
+	// OperatorHome keeps the root key doctrines are signed with.
+	OperatorHome = ".vuvuzela_operator"
+)
+
+// DefaultHome is the directory name in the current user's home.
+func DefaultHome(name string) (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, name), nil
+}
+
+// MakeHome creates doctrineHome, and the directories above it, if it does
+// not exist yet.
+func MakeHome(doctrineHome string) error {
+	_, err := os.Stat(doctrineHome)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	err = os.MkdirAll(doctrineHome, 0700)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created directory %s\n", doctrineHome)
+	return nil
+}
+
+// WriteNewKey generates a key pair of suite and stores it in
+// doctrineHome. The public key is what a client hands to the people it
+// wants to talk to.
+//
+// Both files are written in full before either is renamed into place,
+// the private key last. A crash between the renames leaves a public key
+// that does not go with the private key, which ReadPrivateKey puts right.
+func WriteNewKey(doctrineHome string, suite CryptoSuite) (PrivateKey, error) {
+	keypair, err := suite.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := KeyPassphrase.Get("Passphrase for the new key (empty for none): ", true)
+	if err != nil && err != ErrNoPassphrase {
+		return nil, err
+	}
+	// 生成密钥文件
+	privateData, err := encodePrivateKey(suite, keypair, nil, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	publicType, _ := suite.PEMTypes()
+	publicData := pem.EncodeToMemory(&pem.Block{Type: publicType, Bytes: keypair.Public().Bytes()})
+
+	publicPath := filepath.Join(doctrineHome, PublicKeyFile)
+	privatePath := filepath.Join(doctrineHome, PrivateKeyFile)
+	publicTmp, err := stageFile(publicPath, publicData, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(publicTmp)
+	privateTmp, err := stageFile(privatePath, privateData, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(privateTmp)
+	err = os.Rename(publicTmp, publicPath)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(privateTmp, privatePath)
+	if err != nil {
+		return nil, err
+	}
+	return keypair, nil
+}
+
+// WritePublicKey stores publicKey at path, in the format ReadPublicKey
+// reads.
+func WritePublicKey(path string, suite CryptoSuite, publicKey PublicKey) error {
+	publicType, _ := suite.PEMTypes()
+	return writePEM(path, publicType, publicKey.Bytes(), 0644)
+}
+
+// ReadPrivateKey reads the private key stored in doctrineHome and tells
+// which suite it belongs to. An encrypted key is decrypted with
+// KeyPassphrase.
+//
+// The public key next to it is written again if it does not go with the
+// private key, which is the one that counts.
+func ReadPrivateKey(doctrineHome string) (CryptoSuite, PrivateKey, error) {
+	suite, privateKey, _, err := readPrivateKeyFile(filepath.Join(doctrineHome, PrivateKeyFile), KeyPassphrase) // 读取密钥
+	if err != nil {
+		return nil, nil, err
+	}
+	publicPath := filepath.Join(doctrineHome, PublicKeyFile)
+	publicSuite, publicKey, err := ReadPublicKey(publicPath)
+	if err == nil && publicSuite == suite && bytes.Equal(publicKey.Bytes(), privateKey.Public().Bytes()) {
+		return suite, privateKey, nil
+	}
+	err = WritePublicKey(publicPath, suite, privateKey.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("Wrote %s again to go with %s\n", publicPath, PrivateKeyFile)
+	return suite, privateKey, nil
+}
+
+// readPrivateKeyFile reads the private key at path, decrypting it with a
+// passphrase from p if it is encrypted, and returns it with the headers
+// it was stored with.
+func readPrivateKeyFile(path string, p *PassphraseReader) (CryptoSuite, PrivateKey, map[string]string, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, suite := range Suites {
+		if _, privateType := suite.PEMTypes(); privateType != block.Type {
+			continue
+		}
+		if isEncrypted(block) {
+			passphrase, err := p.Get("Passphrase for "+path+": ", false)
+			if err == ErrNoPassphrase {
+				return nil, nil, nil, fmt.Errorf("%s is encrypted and there is no passphrase for it in $%s or on a terminal", path, p.Env)
+			}
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			err = decryptBlock(block, suite, passphrase)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s: %s", path, err)
+			}
+		}
+		privateKey, err := suite.ParsePrivateKey(block.Bytes)
+		return suite, privateKey, block.Headers, err
+	}
+	return nil, nil, nil, fmt.Errorf("unknown private key type %q", block.Type)
+}
+
+// writePrivateKeyFile stores privateKey at path with headers, encrypted
+// with KeyPassphrase unless there is none or it is empty.
+func writePrivateKeyFile(path string, suite CryptoSuite, privateKey PrivateKey, headers map[string]string) error {
+	passphrase, err := KeyPassphrase.Get("Passphrase for the new key (empty for none): ", true)
+	if err != nil && err != ErrNoPassphrase {
+		return err
+	}
+	return writeEncryptedKey(path, suite, privateKey, headers, passphrase)
+}
+
+// writeEncryptedKey stores privateKey at path with headers, encrypted with
+// passphrase if it is not empty.
+func writeEncryptedKey(path string, suite CryptoSuite, privateKey PrivateKey, headers map[string]string, passphrase []byte) error {
+	data, err := encodePrivateKey(suite, privateKey, headers, passphrase)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// encodePrivateKey is privateKey as writeEncryptedKey stores it.
+func encodePrivateKey(suite CryptoSuite, privateKey PrivateKey, headers map[string]string, passphrase []byte) ([]byte, error) {
+	_, privateType := suite.PEMTypes()
+	block := &pem.Block{Type: privateType, Headers: make(map[string]string), Bytes: privateKey.Bytes()}
+	for k, v := range headers {
+		block.Headers[k] = v
+	}
+	if len(passphrase) > 0 {
+		err := encryptBlock(block, suite, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// ReadPublicKey reads a public key file, e.g. one handed out by a peer,
+// and tells which suite it belongs to.
+func ReadPublicKey(path string) (CryptoSuite, PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, suite := range Suites {
+		if publicType, _ := suite.PEMTypes(); publicType == block.Type {
+			publicKey, err := suite.ParsePublicKey(block.Bytes)
+			return suite, publicKey, err
+		}
+	}
+	return nil, nil, fmt.Errorf("unknown public key type %q", block.Type)
+}
+
+// ReadRootKey reads the pinned root key at path.
+func ReadRootKey(path string) (*RootKey, error) {
+	suite, publicKey, err := ReadPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RootKey{Suite: suite, PublicKey: publicKey}, nil
+}
+
+func writePEM(path, typ string, buf []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: buf})
+	return writeFileAtomic(path, data, perm)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path, so a crash leaves either the old file or the new one,
+// never half of one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := stageFile(path, data, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, path)
+}
+
+// stageFile writes data to a temporary file next to path and returns its
+// name, for the caller to rename over path.
+func stageFile(path string, data []byte, perm os.FileMode) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
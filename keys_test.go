@@ -0,0 +1,105 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteNewKey(t *testing.T) {
+	t.Setenv(PassphraseEnv, "correct horse battery staple")
+	home := t.TempDir()
+
+	privateKey, err := WriteNewKey(home, X25519Suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Fatalf("home has %v, want only %s and %s", names, PrivateKeyFile, PublicKeyFile)
+	}
+
+	suite, read, err := ReadPrivateKey(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite != X25519Suite || !bytes.Equal(read.Bytes(), privateKey.Bytes()) {
+		t.Fatal("read back another key")
+	}
+	checkPublicKey(t, home, privateKey)
+}
+
+// A crash between the renames of WriteNewKey leaves the public key of
+// another key pair, or none, next to the private key.
+func TestReadPrivateKeyRepairsPublicKey(t *testing.T) {
+	t.Setenv(PassphraseEnv, "correct horse battery staple")
+	home := t.TempDir()
+	privateKey, err := WriteNewKey(home, X25519Suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPath := filepath.Join(home, PublicKeyFile)
+
+	other, err := SM2Suite.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WritePublicKey(publicPath, SM2Suite, other.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ReadPrivateKey(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPublicKey(t, home, privateKey)
+
+	err = os.Remove(publicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ReadPrivateKey(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPublicKey(t, home, privateKey)
+}
+
+func checkPublicKey(t *testing.T, home string, privateKey PrivateKey) {
+	t.Helper()
+	_, publicKey, err := ReadPublicKey(filepath.Join(home, PublicKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(publicKey.Bytes(), privateKey.Public().Bytes()) {
+		t.Fatalf("%s does not go with %s", PublicKeyFile, PrivateKeyFile)
+	}
+}
+
+func TestRotateKeyOverlap(t *testing.T) {
+	t.Setenv(PassphraseEnv, "correct horse battery staple")
+	home := t.TempDir()
+	if _, err := WriteNewKey(home, X25519Suite); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := RotateKey(home, NetworkDoctrineMaxAge); err == nil {
+		t.Fatal("rotated with an overlap clients cannot keep up with")
+	}
+	_, _, until, err := RotateKey(home, DefaultKeyOverlap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until.Before(time.Now().Add(MinKeyOverlap)) {
+		t.Fatalf("old key retired at %s", until)
+	}
+}
@@ -2,12 +2,13 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package vuvuzela
 
 import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 )
 
@@ -16,32 +17,64 @@ type Laplace struct {
 	B  float64
 }
 
-func (l Laplace) Uint32() uint32 {
-	x := laplace(l.Mu, l.B)
-	if x < 0 {
-		return l.Uint32()
-	}
+// Uint32 draws a noise count from l with DefaultSampler.
+func (l Laplace) Uint32() (uint32, error) {
+	return DefaultSampler.Uint32(l)
+}
 
-	return uint32(x)
+// LaplaceSampler draws from Laplace distributions with the randomness of
+// Rand.
+type LaplaceSampler struct {
+	Rand io.Reader
 }
 
-func laplace(mu, b float64) float64 {
-	r := make([]byte, 8)
-	if _, err := rand.Read(r); err != nil {
-		fmt.Printf("generate random num error: %s\n", err)
-	}
+// DefaultSampler draws with crypto/rand: the noise counts must not be
+// predictable.
+var DefaultSampler = &LaplaceSampler{Rand: rand.Reader}
 
-	x := binary.BigEndian.Uint64(r)
-	u := float64(x)/float64(^uint64(0)) - .5
+// Uint32 draws a count from l: the draw is rounded up, and cut off at 0
+// and at the largest uint32. Cutting off rather than drawing again keeps
+// the distribution above 0 what the privacy analysis assumes.
+func (s *LaplaceSampler) Uint32(l Laplace) (uint32, error) {
+	x, err := s.Float64(l)
+	if err != nil {
+		return 0, err
+	}
+	x = math.Ceil(x)
+	switch {
+	case x <= 0:
+		return 0, nil
+	case x >= math.MaxUint32:
+		return math.MaxUint32, nil
+	}
+	return uint32(x), nil
+}
 
-	var abs, sign float64
-	if u < 0 {
-		abs = -u
-		sign = -1
-	} else {
-		abs = u
-		sign = 1
+// Float64 draws from l by inverting its distribution function.
+func (s *LaplaceSampler) Float64(l Laplace) (float64, error) {
+	if math.IsNaN(l.Mu) || math.IsInf(l.Mu, 0) || !(l.B >= 0) || math.IsInf(l.B, 0) {
+		return 0, fmt.Errorf("bad laplace distribution mu %v b %v", l.Mu, l.B)
+	}
+	u, err := s.uniform()
+	if err != nil {
+		return 0, err
+	}
+	if u < 0.5 {
+		return l.Mu + l.B*math.Log(2*u), nil
 	}
+	return l.Mu - l.B*math.Log(2*(1-u)), nil
+}
 
-	return mu - b*sign*math.Log(1-2*abs)
+// uniform draws uniformly from the open interval (0, 1), so the logarithms
+// of Float64 stay finite: 52 random bits offset by half a step from both
+// ends. With 53 bits, the precision of a float64, the top draw would round
+// to 1.
+func (s *LaplaceSampler) uniform() (float64, error) {
+	var r [8]byte
+	_, err := io.ReadFull(s.Rand, r[:])
+	if err != nil {
+		return 0, fmt.Errorf("generate random num: %s", err)
+	}
+	x := binary.BigEndian.Uint64(r[:]) >> 12
+	return (float64(x) + 0.5) / (1 << 52), nil
 }
@@ -0,0 +1,141 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// testSampler draws with a fixed seed, so the tests do not flake.
+func testSampler() *LaplaceSampler {
+	return &LaplaceSampler{Rand: rand.New(rand.NewSource(1))}
+}
+
+func laplaceCDF(l Laplace, x float64) float64 {
+	if x < l.Mu {
+		return math.Exp((x-l.Mu)/l.B) / 2
+	}
+	return 1 - math.Exp(-(x-l.Mu)/l.B)/2
+}
+
+func TestLaplaceDistribution(t *testing.T) {
+	const n = 200000
+	l := Laplace{Mu: 10, B: 3}
+	s := testSampler()
+
+	xs := make([]float64, n)
+	var sum float64
+	for i := range xs {
+		x, err := s.Float64(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xs[i] = x
+		sum += x
+	}
+	mean := sum / n
+	var squares float64
+	for _, x := range xs {
+		squares += (x - mean) * (x - mean)
+	}
+	variance := squares / (n - 1)
+
+	// the standard errors are about 0.01 for the mean and 0.09 for the
+	// variance
+	if math.Abs(mean-l.Mu) > 0.05 {
+		t.Errorf("mean %.4f, want %.4f", mean, l.Mu)
+	}
+	if want := 2 * l.B * l.B; math.Abs(variance-want) > 0.5 {
+		t.Errorf("variance %.4f, want %.4f", variance, want)
+	}
+
+	// Kolmogorov-Smirnov against the distribution function, at a
+	// significance of 0.001
+	sort.Float64s(xs)
+	var d float64
+	for i, x := range xs {
+		cdf := laplaceCDF(l, x)
+		d = math.Max(d, math.Max(float64(i+1)/n-cdf, cdf-float64(i)/n))
+	}
+	if critical := 1.95 / math.Sqrt(n); d > critical {
+		t.Errorf("KS distance %.5f, want at most %.5f", d, critical)
+	}
+}
+
+func TestLaplaceUint32(t *testing.T) {
+	s := testSampler()
+	for _, test := range []struct {
+		l    Laplace
+		want uint32
+	}{
+		// no spread: the mean, rounded up
+		{Laplace{Mu: 5.2, B: 0}, 6},
+		{Laplace{Mu: 5, B: 0}, 5},
+		// cut off at 0 and at the largest uint32
+		{Laplace{Mu: -1e6, B: 1}, 0},
+		{Laplace{Mu: 1e12, B: 1}, math.MaxUint32},
+		{Laplace{Mu: math.MaxUint32, B: 0}, math.MaxUint32},
+	} {
+		for i := 0; i < 100; i++ {
+			got, err := s.Uint32(test.l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("%+v: got %d, want %d", test.l, got, test.want)
+			}
+		}
+	}
+}
+
+// The ends of the random numbers give the smallest and largest draws,
+// which have to stay finite.
+func TestLaplaceExtremes(t *testing.T) {
+	l := Laplace{Mu: 0, B: 1}
+	for _, b := range []byte{0x00, 0xff} {
+		s := &LaplaceSampler{Rand: bytes.NewReader(bytes.Repeat([]byte{b}, 8))}
+		x, err := s.Float64(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.IsInf(x, 0) || math.IsNaN(x) || math.Abs(x) > 40 {
+			t.Fatalf("random bytes %#x: drew %v", b, x)
+		}
+		if (b == 0) != (x < 0) {
+			t.Fatalf("random bytes %#x: drew %v on the wrong side", b, x)
+		}
+	}
+}
+
+func TestLaplaceErrors(t *testing.T) {
+	l := Laplace{Mu: 10, B: 3}
+	failing := errors.New("no entropy")
+	for _, s := range []*LaplaceSampler{
+		{Rand: iotest.ErrReader(failing)},
+		// short reads are errors too
+		{Rand: bytes.NewReader([]byte{1, 2, 3})},
+	} {
+		_, err := s.Uint32(l)
+		if err == nil || !strings.HasPrefix(err.Error(), "generate random num") {
+			t.Fatalf("got error %v", err)
+		}
+	}
+
+	for _, bad := range []Laplace{
+		{Mu: math.NaN(), B: 1},
+		{Mu: math.Inf(1), B: 1},
+		{Mu: 10, B: -1},
+		{Mu: 10, B: math.NaN()},
+		{Mu: 10, B: math.Inf(1)},
+	} {
+		_, err := testSampler().Uint32(bad)
+		if err == nil {
+			t.Fatalf("%+v: no error", bad)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package vuvuzela
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// LastServer is the last server of the chain. It runs the dead drops of
+// conversation rounds and publishes the invitations of dialing rounds.
+type LastServer struct {
+	Topology *Topology
+	Keys     *KeyRing
+	// Root is the key the doctrine of the previous hop is checked
+	// against when it opens its link.
+	Root *RootKey
+
+	replays map[byte]*ReplayFilter
+}
+
+// ListenAndServe takes rounds from the previous hop on the last server's
+// message address until accepting a connection fails.
+func (s *LastServer) ListenAndServe() error {
+	s.replays = newReplayFilters()
+	l, err := net.Listen("tcp", ListenAddr(s.Topology.Last().MessageAddr))
+	if err != nil {
+		return err
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		// start a new goroutine to handle
+		// the new connection.
+		go s.handleConn(c)
+	}
+}
+
+// handleConn takes the link the previous hop opens, and handles the
+// rounds it forwards over it.
+func (s *LastServer) handleConn(c net.Conn) {
+	defer c.Close()
+	link, err := acceptHop(c, s.Topology, len(s.Topology.Servers)-1, s.Keys, s.Root)
+	if err != nil {
+		fmt.Printf("refuse link from %s: %s\n", c.RemoteAddr(), err)
+		return
+	}
+	for {
+		kind, round, onions, err := link.ReadBatch(FrameBatch, OnionSize(s.Keys.Suite, 1))
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("read batch error:", err)
+			}
+			return
+		}
+		// the previous hop vouches for the round, so it may move the
+		// replay window
+		if filter, ok := s.replays[kind]; ok {
+			filter.Advance(round)
+		}
+		switch kind {
+		case BatchConvo:
+			go s.handleConvo(link, round, onions)
+		case BatchDial:
+			go s.handleDial(link, round, onions)
+		default:
+			fmt.Printf("unknown batch kind %d\n", kind)
+		}
+	}
+}
+
+// handleConvo opens every onion of a conversation round, runs the dead
+// drop exchange and sends back one reply per onion, in the order the
+// onions came in, each sealed under the reply key of its onion.
+func (s *LastServer) handleConvo(link *hopLink, round uint32, onions [][]byte) {
+	exchanges := make([][]byte, len(onions))
+	replyKeys := make([][]byte, len(onions))
+	for i, onion := range onions {
+		inner, replyKey, err := s.Keys.OpenLayer(BatchConvo, round, onion)
+		if err != nil || replayed(s.replays[BatchConvo], round, replyKey, link.RemoteAddr()) {
+			continue
+		}
+		replyKeys[i] = replyKey
+		exchanges[i] = inner
+	}
+
+	replies := exchangeDeadDrops(round, exchanges)
+	var err error
+	for i, reply := range replies {
+		if replyKeys[i] == nil {
+			replies[i] = RandomReply(ReplySize(1))
+			continue
+		}
+		replies[i], err = SealReply(s.Keys.Suite, replyKeys[i], reply)
+		if err != nil {
+			fmt.Printf("seal reply error: %s\n", err)
+			replies[i] = RandomReply(ReplySize(1))
+		}
+	}
+	err = link.WriteBatch(FrameReplies, BatchConvo, round, replies)
+	if err != nil {
+		fmt.Println("write replies error:", err)
+	}
+}
+
+// handleDial opens every onion of a dialing round and publishes the
+// invitations in it: they go back up the chain to the entry server, each
+// prefixed with the bucket it was sent to.
+func (s *LastServer) handleDial(link *hopLink, round uint32, onions [][]byte) {
+	var exchanges [][]byte
+	buckets := make(map[uint32]int)
+	for _, onion := range onions {
+		inner, replyKey, err := s.Keys.OpenLayer(BatchDial, round, onion)
+		if err != nil || replayed(s.replays[BatchDial], round, replyKey, link.RemoteAddr()) {
+			continue
+		}
+		ex := inner[:DialExchangeSize(s.Keys.Suite)]
+		exchanges = append(exchanges, ex)
+		buckets[binary.BigEndian.Uint32(ex[:SizeBucket])]++
+	}
+	fmt.Printf("dialing round %d: %d onions, %d invitations in %d buckets\n", round, len(onions), len(exchanges), len(buckets))
+
+	err := link.WriteBatch(FrameReplies, BatchDial, round, exchanges)
+	if err != nil {
+		fmt.Println("write invitations error:", err)
+	}
+}
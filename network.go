@@ -0,0 +1,327 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+// NetworkDoctrineFile is where a server keeps the network doctrine it
+// hands out next to its own, and where a client caches it.
+const NetworkDoctrineFile = "network.json"
+
+// NetworkDoctrineMaxAge is how long a client uses a cached network
+// doctrine before it fetches it again, at startup and while it runs, so
+// it learns about rotated keys well before the old ones are retired.
+const NetworkDoctrineMaxAge = time.Hour
+
+// A NetworkDoctrine describes the whole chain in one document: every
+// server in order with its root signed doctrine, and the parameters the
+// chain runs with. Every server of the chain signs the whole document
+// with its own key, so a client that gets it from one server knows the
+// rest of the chain agrees with it.
+type NetworkDoctrine struct {
+	// Version goes up every time the chain changes.
+	Version        uint64
+	Servers        []*NetworkServer
+	RoundDelay     time.Duration
+	DialRoundDelay time.Duration
+	// Privacy is what the servers promise conversations, and Noise what
+	// they add to every conversation round for it.
+	Privacy   PrivacyBudget
+	Noise     ConvoNoise
+	DialNoise Laplace
+	// Signatures has the signature of every server, in chain order.
+	Signatures [][]byte
+}
+
+// NetworkServer is a server of a NetworkDoctrine.
+type NetworkServer struct {
+	Name         string
+	DoctrineAddr string
+	Doctrine     *Doctrine
+}
+
+// Network is a chain of servers with the public keys their doctrines
+// advertise, and the privacy its noise gives.
+type Network struct {
+	Topology   *Topology
+	Suite      CryptoSuite
+	PublicKeys []PublicKey
+	Privacy    PrivacyBudget
+	Noise      ConvoNoise
+}
+
+var networkDoctrineContext = []byte("vuvuzela network doctrine\n")
+
+// NewNetworkDoctrine fetches the doctrine of every server of topology,
+// checks it against root and puts them together with the parameters this
+// build runs with and the noise that gives privacy. Nobody has signed it
+// yet.
+func NewNetworkDoctrine(topology *Topology, root *RootKey, version uint64, privacy PrivacyBudget) (*NetworkDoctrine, error) {
+	convoNoise, err := privacy.Calibrate()
+	if err != nil {
+		return nil, err
+	}
+	nd := &NetworkDoctrine{
+		Version:        version,
+		Servers:        make([]*NetworkServer, len(topology.Servers)),
+		RoundDelay:     RoundDelay,
+		DialRoundDelay: DialRoundDelay,
+		Privacy:        privacy,
+		Noise:          convoNoise,
+		DialNoise:      *dialNoise,
+		Signatures:     make([][]byte, len(topology.Servers)),
+	}
+	for i, server := range topology.Servers {
+		doctrine, err := FetchDoctrine(server.DoctrineAddr)
+		if err != nil {
+			return nil, fmt.Errorf("fetch doctrine of %s: %s", server.Name, err)
+		}
+		nd.Servers[i] = &NetworkServer{
+			Name:         server.Name,
+			DoctrineAddr: server.DoctrineAddr,
+			Doctrine:     doctrine,
+		}
+	}
+	_, err = nd.network(root, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+// Topology is the chain the network doctrine describes.
+func (nd *NetworkDoctrine) Topology() *Topology {
+	topology := new(Topology)
+	for _, server := range nd.Servers {
+		topology.Servers = append(topology.Servers, &ServerInfo{
+			Name:         server.Name,
+			MessageAddr:  server.Doctrine.Addr,
+			DoctrineAddr: server.DoctrineAddr,
+		})
+	}
+	return topology
+}
+
+// signedBytes is what every server signs: the whole document but the
+// signatures, length prefixed.
+func (nd *NetworkDoctrine) signedBytes() []byte {
+	buf := bytes.NewBuffer(append([]byte{}, networkDoctrineContext...))
+	field := func(b []byte) {
+		binary.Write(buf, binary.BigEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+	binary.Write(buf, binary.BigEndian, nd.Version)
+	binary.Write(buf, binary.BigEndian, int64(nd.RoundDelay))
+	binary.Write(buf, binary.BigEndian, int64(nd.DialRoundDelay))
+	binary.Write(buf, binary.BigEndian, math.Float64bits(nd.Privacy.Epsilon))
+	binary.Write(buf, binary.BigEndian, math.Float64bits(nd.Privacy.Delta))
+	binary.Write(buf, binary.BigEndian, int64(nd.Privacy.Rounds))
+	for _, l := range []Laplace{nd.Noise.Single, nd.Noise.Double, nd.DialNoise} {
+		binary.Write(buf, binary.BigEndian, math.Float64bits(l.Mu))
+		binary.Write(buf, binary.BigEndian, math.Float64bits(l.B))
+	}
+	binary.Write(buf, binary.BigEndian, uint32(len(nd.Servers)))
+	for _, server := range nd.Servers {
+		field([]byte(server.Name))
+		field([]byte(server.DoctrineAddr))
+		field(server.Doctrine.signedBytes())
+		field(server.Doctrine.Signature)
+	}
+	return buf.Bytes()
+}
+
+// Sign adds the signature of the owner of privateKey, a key of suite, who
+// has to be one of the servers of the network doctrine.
+func (nd *NetworkDoctrine) Sign(suite CryptoSuite, privateKey PrivateKey) error {
+	self := privateKey.Public().Bytes()
+	for i, server := range nd.Servers {
+		if server.Doctrine == nil || !bytes.Equal(server.Doctrine.PublicKey, self) {
+			continue
+		}
+		if len(nd.Signatures) != len(nd.Servers) {
+			nd.Signatures = make([][]byte, len(nd.Servers))
+		}
+		signature, err := suite.Sign(privateKey, nd.signedBytes())
+		if err != nil {
+			return err
+		}
+		nd.Signatures[i] = signature
+		return nil
+	}
+	return errors.New("our key is not in the network doctrine")
+}
+
+// Verify checks that every server's doctrine is signed by root and valid
+// at now, and that every server signed the network doctrine, and returns
+// the network it describes.
+func (nd *NetworkDoctrine) Verify(root *RootKey, now time.Time) (*Network, error) {
+	network, err := nd.network(root, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(nd.Signatures) != len(nd.Servers) {
+		return nil, fmt.Errorf("network doctrine has %d signatures for %d servers", len(nd.Signatures), len(nd.Servers))
+	}
+	msg := nd.signedBytes()
+	for i, server := range nd.Servers {
+		if len(nd.Signatures[i]) == 0 {
+			return nil, fmt.Errorf("%s did not sign the network doctrine", server.Name)
+		}
+		if !network.Suite.Verify(network.PublicKeys[i], msg, nd.Signatures[i]) {
+			return nil, fmt.Errorf("wrong signature of %s on the network doctrine", server.Name)
+		}
+	}
+	return network, nil
+}
+
+// network checks the doctrines of the servers and returns the network
+// they make up, without looking at the signatures on the whole document.
+func (nd *NetworkDoctrine) network(root *RootKey, now time.Time) (*Network, error) {
+	if len(nd.Servers) < 2 {
+		return nil, fmt.Errorf("network doctrine needs at least 2 servers, got %d", len(nd.Servers))
+	}
+	for _, server := range nd.Servers {
+		if server.Doctrine == nil {
+			return nil, fmt.Errorf("%s has no doctrine", server.Name)
+		}
+	}
+	err := nd.Noise.Verify(nd.Privacy)
+	if err != nil {
+		return nil, fmt.Errorf("network doctrine promises %s: %s", nd.Privacy, err)
+	}
+	topology := nd.Topology()
+	network := &Network{
+		Topology:   topology,
+		PublicKeys: make([]PublicKey, len(nd.Servers)),
+		Privacy:    nd.Privacy,
+		Noise:      nd.Noise,
+	}
+	for i, server := range nd.Servers {
+		suite, publicKey, err := server.Doctrine.Verify(root, now)
+		if err != nil {
+			return nil, fmt.Errorf("doctrine of %s: %s", server.Name, err)
+		}
+		if role := topology.RoleOf(i); server.Doctrine.Role != role {
+			return nil, fmt.Errorf("%s is a %s server, not a %s server", server.Name, server.Doctrine.Role, role)
+		}
+		if network.Suite == nil {
+			network.Suite = suite
+		} else if suite != network.Suite {
+			return nil, fmt.Errorf("%s runs crypto suite %s, %s runs %s", server.Name, suite.Name(), nd.Servers[0].Name, network.Suite.Name())
+		}
+		network.PublicKeys[i] = publicKey
+	}
+	return network, nil
+}
+
+// matches reports whether the network doctrine describes the same chain
+// as topology.
+func (nd *NetworkDoctrine) matches(topology *Topology) bool {
+	if len(nd.Servers) != len(topology.Servers) {
+		return false
+	}
+	for i, server := range nd.Servers {
+		if server.Doctrine == nil || server.Doctrine.Addr != topology.Servers[i].MessageAddr {
+			return false
+		}
+	}
+	return true
+}
+
+func ReadNetworkDoctrine(path string) (*NetworkDoctrine, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	nd := new(NetworkDoctrine)
+	err = json.Unmarshal(data, nd)
+	return nd, err
+}
+
+func WriteNetworkDoctrine(path string, nd *NetworkDoctrine) error {
+	buf, err := json.Marshal(nd)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf, 0600)
+}
+
+// FetchNetworkDoctrine gets the network doctrine the server at addr hands
+// out after its own doctrine.
+func FetchNetworkDoctrine(addr string) (*NetworkDoctrine, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_, err = ExpectFrame(conn, FrameDoctrine, MaxDoctrineSize)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ExpectFrame(conn, FrameNetworkDoctrine, MaxDoctrineSize)
+	if err != nil {
+		return nil, fmt.Errorf("no network doctrine: %s", err)
+	}
+	nd := new(NetworkDoctrine)
+	err = json.Unmarshal(buf, nd)
+	return nd, err
+}
+
+// LoadNetwork returns the network of topology as described by its network
+// doctrine. The network doctrine is cached at cachePath and only fetched
+// from the entry server when there is no cache, the cache is older than
+// NetworkDoctrineMaxAge, no longer verifies or describes another chain,
+// or refresh is set. A fetched
+// network doctrine older than the cached one is refused.
+func LoadNetwork(topology *Topology, root *RootKey, cachePath string, refresh bool) (*Network, error) {
+	now := time.Now()
+	cached, err := ReadNetworkDoctrine(cachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("read cached network doctrine: %s\n", err)
+		}
+		cached = nil
+	} else if !refresh && cached.matches(topology) && !cacheExpired(cachePath, now) {
+		network, err := cached.Verify(root, now)
+		if err == nil {
+			return network, nil
+		}
+		fmt.Printf("cached network doctrine: %s, fetching a new one\n", err)
+	}
+
+	nd, err := FetchNetworkDoctrine(topology.Entry().DoctrineAddr)
+	if err != nil {
+		return nil, err
+	}
+	network, err := nd.Verify(root, now)
+	if err != nil {
+		return nil, err
+	}
+	if !nd.matches(topology) {
+		return nil, errors.New("network doctrine describes another chain than the topology")
+	}
+	if cached != nil && nd.Version < cached.Version {
+		return nil, fmt.Errorf("network doctrine version %d is older than cached version %d", nd.Version, cached.Version)
+	}
+	err = WriteNetworkDoctrine(cachePath, nd)
+	if err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+// cacheExpired reports whether the cache at path is older than
+// NetworkDoctrineMaxAge.
+func cacheExpired(path string, now time.Time) bool {
+	info, err := os.Stat(path)
+	return err != nil || now.Sub(info.ModTime()) > NetworkDoctrineMaxAge
+}
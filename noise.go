@@ -0,0 +1,164 @@
+package vuvuzela
+
+import (
+	"runtime"
+	"sync"
+)
+
+// DefaultNoiseAhead is how many rounds past the current one a NoisePool
+// precomputes by default.
+const DefaultNoiseAhead = 2
+
+// NoisePool wraps the noise of the rounds of one kind in onions, on
+// Workers goroutines, and keeps the noise of up to Ahead upcoming rounds
+// ready. Onions are bound to their round, so rounds are expected to come
+// in order: noise precomputed for rounds that do not come is thrown away.
+type NoisePool struct {
+	Kind    byte
+	Workers int
+	Ahead   int
+	// Bodies draws the noise of a round and returns what goes into the
+	// onions.
+	Bodies func() ([][]byte, error)
+	// Wrap wraps one body in an onion for round.
+	Wrap func(kind byte, round uint32, body []byte) ([]byte, error)
+
+	once   sync.Once
+	jobs   chan noiseJob
+	mu     sync.Mutex
+	rounds map[uint32]*noiseRound
+}
+
+// noiseRound is the noise of one round, ready when done is closed.
+type noiseRound struct {
+	number uint32
+	onions [][]byte
+	done   chan struct{}
+
+	mu       sync.Mutex
+	err      error
+	canceled bool
+}
+
+type noiseJob struct {
+	round *noiseRound
+	index int
+	body  []byte
+	wg    *sync.WaitGroup
+}
+
+func NewNoisePool(kind byte, bodies func() ([][]byte, error), wrap func(byte, uint32, []byte) ([]byte, error)) *NoisePool {
+	return &NoisePool{
+		Kind:    kind,
+		Workers: runtime.NumCPU(),
+		Ahead:   DefaultNoiseAhead,
+		Bodies:  bodies,
+		Wrap:    wrap,
+	}
+}
+
+// Take returns the noise of round, waiting for it if it is not ready
+// yet, and starts on the rounds after it.
+func (p *NoisePool) Take(round uint32) ([][]byte, error) {
+	p.once.Do(p.start)
+
+	p.mu.Lock()
+	r := p.rounds[round]
+	if r == nil {
+		r = p.precompute(round)
+	}
+	delete(p.rounds, round)
+	for n, old := range p.rounds {
+		if n < round || n > round+uint32(p.Ahead) {
+			old.cancel()
+			delete(p.rounds, n)
+		}
+	}
+	for n := round + 1; n <= round+uint32(p.Ahead); n++ {
+		if p.rounds[n] == nil {
+			p.rounds[n] = p.precompute(n)
+		}
+	}
+	p.mu.Unlock()
+
+	<-r.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.onions, nil
+}
+
+// Stop throws away the noise precomputed for rounds nobody took.
+func (p *NoisePool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for n, r := range p.rounds {
+		r.cancel()
+		delete(p.rounds, n)
+	}
+}
+
+func (p *NoisePool) start() {
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	p.rounds = make(map[uint32]*noiseRound)
+	p.jobs = make(chan noiseJob, workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+}
+
+// precompute draws the noise of round and queues its onions for the
+// workers. It is called with p.mu held.
+func (p *NoisePool) precompute(round uint32) *noiseRound {
+	r := &noiseRound{number: round, done: make(chan struct{})}
+	bodies, err := p.Bodies()
+	if err != nil {
+		r.err = err
+		close(r.done)
+		return r
+	}
+	r.onions = make([][]byte, len(bodies))
+	wg := new(sync.WaitGroup)
+	wg.Add(len(bodies))
+	go func() {
+		for i, body := range bodies {
+			p.jobs <- noiseJob{round: r, index: i, body: body, wg: wg}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(r.done)
+	}()
+	return r
+}
+
+func (p *NoisePool) work() {
+	for job := range p.jobs {
+		r := job.round
+		r.mu.Lock()
+		skip := r.canceled || r.err != nil
+		r.mu.Unlock()
+		if !skip {
+			onion, err := p.Wrap(p.Kind, r.number, job.body)
+			r.mu.Lock()
+			if err != nil && r.err == nil {
+				r.err = err
+			}
+			r.onions[job.index] = onion
+			r.mu.Unlock()
+		}
+		job.wg.Done()
+	}
+}
+
+// cancel stops the work on noise nobody is going to take.
+func (r *noiseRound) cancel() {
+	r.mu.Lock()
+	r.canceled = true
+	r.mu.Unlock()
+}
@@ -0,0 +1,58 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+// benchmarkNoisePool takes rounds of bodies noise messages from a pool
+// that wraps them for the two servers after the entry server of a chain of
+// three, the way the entry server does. Nothing is precomputed, so every
+// Take waits for the workers to wrap its whole round: precomputing hides
+// that time only if it is less than RoundDelay.
+func benchmarkNoisePool(b *testing.B, suite CryptoSuite, bodies int) {
+	var downstream []PublicKey
+	for i := 0; i < 2; i++ {
+		key, err := suite.GenerateKey()
+		if err != nil {
+			b.Fatal(err)
+		}
+		downstream = append(downstream, key.Public())
+	}
+	body := make([]byte, SizeMessageBody)
+	rand.Read(body)
+	noise := make([][]byte, bodies)
+	for i := range noise {
+		noise[i] = body
+	}
+	p := NewNoisePool(BatchConvo, func() ([][]byte, error) {
+		return noise, nil
+	}, func(kind byte, round uint32, body []byte) ([]byte, error) {
+		onion, _, err := WrapOnion(suite, downstream, kind, round, body)
+		return onion, err
+	})
+	p.Ahead = 0
+	defer p.Stop()
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		onions, err := p.Take(uint32(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(onions) != bodies {
+			b.Fatalf("got %d onions, want %d", len(onions), bodies)
+		}
+	}
+	b.ReportMetric(float64(b.N*bodies)/time.Since(start).Seconds(), "onions/s")
+}
+
+func BenchmarkNoisePoolSM2(b *testing.B) {
+	benchmarkNoisePool(b, SM2Suite, 2000)
+}
+
+func BenchmarkNoisePoolX25519(b *testing.B) {
+	benchmarkNoisePool(b, X25519Suite, 2000)
+}
@@ -0,0 +1,105 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	SizeMessageBody = 238
+	SizeRound       = 4
+	SizeDeadline    = 8
+	SizeTag         = 16
+	SizeOnionHeader = 1 + SizeRound
+)
+
+// OnionSize is the size of an onion that still has layers layers to peel.
+// Every layer adds the suite's layer overhead.
+func OnionSize(suite CryptoSuite, layers int) int {
+	return SizeMessageBody + layers*suite.LayerOverhead()
+}
+
+// ReplySize is the size of a reply that has been sealed by layers servers
+// on its way back.
+func ReplySize(layers int) int {
+	return SizeMessageBody + layers*SizeTag
+}
+
+// WrapOnion seals body in one layer per server, innermost for the last
+// server in the chain. Every layer is bound to the kind and round of the
+// onion, so it cannot be replayed into another round. The keys each
+// server will seal our reply with are returned in chain order.
+func WrapOnion(suite CryptoSuite, publicKeys []PublicKey, kind byte, round uint32, body []byte) ([]byte, [][]byte, error) {
+	onion := body
+	replyKeys := make([][]byte, len(publicKeys))
+	ad := onionHeader(kind, round)
+	for i := len(publicKeys) - 1; i >= 0; i-- {
+		var err error
+		onion, replyKeys[i], err = suite.SealLayer(publicKeys[i], ad, onion)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return onion, replyKeys, nil
+}
+
+// OpenLayer opens our layer of an onion for round of kind and returns
+// the onion for the next hop and the key to seal its reply with. It fails
+// for onions made for another server, kind or round.
+func OpenLayer(suite CryptoSuite, privateKey PrivateKey, kind byte, round uint32, onion []byte) ([]byte, []byte, error) {
+	return suite.OpenLayer(privateKey, onionHeader(kind, round), onion)
+}
+
+// onionHeader is the kind and round an onion is sent with. It is the
+// associated data of every layer of the onion.
+func onionHeader(kind byte, round uint32) []byte {
+	header := make([]byte, SizeOnionHeader)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], round)
+	return header
+}
+
+// EncodeOnion is the payload of the FrameOnion a client sends onion for
+// round of kind in.
+func EncodeOnion(kind byte, round uint32, onion []byte) []byte {
+	return append(onionHeader(kind, round), onion...)
+}
+
+// ParseOnion splits the payload of a FrameOnion.
+func ParseOnion(payload []byte) (kind byte, round uint32, onion []byte, err error) {
+	if len(payload) < SizeOnionHeader {
+		return 0, 0, nil, errors.New("onion too short")
+	}
+	return payload[0], binary.BigEndian.Uint32(payload[1:]), payload[SizeOnionHeader:], nil
+}
+
+// SealReply encrypts a reply on its way back to the client under the
+// reply key of our layer of the onion.
+func SealReply(suite CryptoSuite, replyKey, reply []byte) ([]byte, error) {
+	aead, err := suite.NewAEAD(replyKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(nil, nonce, reply, nil), nil
+}
+
+// OpenReply removes the layer a server sealed a reply with.
+func OpenReply(suite CryptoSuite, replyKey, reply []byte) ([]byte, error) {
+	aead, err := suite.NewAEAD(replyKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(nil, nonce, reply, nil)
+}
+
+// RandomReply stands in for the reply to an onion that could not be
+// opened.
+func RandomReply(size int) []byte {
+	buf := make([]byte, size)
+	io.ReadFull(rand.Reader, buf)
+	return buf
+}
@@ -0,0 +1,232 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// PassphraseEnv is the environment variable the passphrase of a
+// binary's private keys can be given in.
+const PassphraseEnv = "VUVUZELA_PASSPHRASE"
+
+// Private keys are sealed under a key derived from the passphrase with
+// scrypt, with the AEAD of the key's own suite. The salt goes in a PEM
+// header next to the one that marks the key encrypted.
+const (
+	procTypeHeader  = "Proc-Type"
+	procTypeEncrypt = "4,ENCRYPTED"
+	saltHeader      = "Scrypt-Salt"
+	sizeSalt        = 16
+	scryptN         = 1 << 15
+	scryptR         = 8
+	scryptP         = 1
+)
+
+var ErrNoPassphrase = errors.New("no passphrase")
+
+// PassphraseReader gets the passphrase of the private keys of a binary,
+// the first time it is needed: from file descriptor Fd if it is not -1,
+// else from the environment variable Env if it is set, else from the
+// terminal. It remembers the passphrase, so every key of a binary has
+// the same one.
+type PassphraseReader struct {
+	Fd  int
+	Env string
+
+	mu         sync.Mutex
+	known      bool
+	passphrase []byte
+}
+
+// RootPassphraseEnv is the environment variable the passphrase of the
+// operator's root key can be given in, when a server signs its own
+// doctrine with it.
+const RootPassphraseEnv = "VUVUZELA_ROOT_PASSPHRASE"
+
+// KeyPassphrase is the passphrase private keys are encrypted with.
+var KeyPassphrase = &PassphraseReader{Fd: -1, Env: PassphraseEnv}
+
+// RootPassphrase is the passphrase of the operator's root key, when it is
+// not the key of the binary itself.
+var RootPassphrase = &PassphraseReader{Fd: -1, Env: RootPassphraseEnv}
+
+// Get returns the passphrase, asking with prompt if it has to ask on the
+// terminal. With confirm it asks twice, for new passphrases. It returns
+// ErrNoPassphrase if there is nowhere to get a passphrase from.
+func (p *PassphraseReader) Get(prompt string, confirm bool) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.known {
+		return p.passphrase, nil
+	}
+
+	var passphrase []byte
+	var err error
+	switch {
+	case p.Fd >= 0:
+		passphrase, err = readLine(os.NewFile(uintptr(p.Fd), "passphrase"))
+	case p.Env != "" && os.Getenv(p.Env) != "":
+		passphrase = []byte(os.Getenv(p.Env))
+	default:
+		passphrase, err = askPassphrase(prompt, confirm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.known = true
+	p.passphrase = passphrase
+	return passphrase, nil
+}
+
+// askPassphrase asks for a passphrase on the terminal, without echo where
+// we know how to turn it off.
+func askPassphrase(prompt string, confirm bool) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, ErrNoPassphrase
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	passphrase, err := readPassword(tty)
+	if err != nil || !confirm || len(passphrase) == 0 {
+		return passphrase, err
+	}
+	fmt.Fprint(tty, "Again: ")
+	again, err := readPassword(tty)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// readLine reads up to the end of the line, one byte at a time so nothing
+// after the line is consumed.
+func readLine(r io.Reader) ([]byte, error) {
+	var line []byte
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+func isEncrypted(block *pem.Block) bool {
+	return block.Headers[procTypeHeader] == procTypeEncrypt
+}
+
+// encryptBlock seals the key in block under passphrase.
+func encryptBlock(block *pem.Block, suite CryptoSuite, passphrase []byte) error {
+	salt := make([]byte, sizeSalt)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return err
+	}
+	aead, err := passphraseAEAD(suite, passphrase, salt)
+	if err != nil {
+		return err
+	}
+	if block.Headers == nil {
+		block.Headers = make(map[string]string)
+	}
+	block.Headers[procTypeHeader] = procTypeEncrypt
+	block.Headers[saltHeader] = hex.EncodeToString(salt)
+	// the key is fresh for every salt, so the nonce can be fixed
+	nonce := make([]byte, aead.NonceSize())
+	block.Bytes = aead.Seal(nil, nonce, block.Bytes, []byte(block.Type))
+	return nil
+}
+
+// decryptBlock opens the key in block with passphrase.
+func decryptBlock(block *pem.Block, suite CryptoSuite, passphrase []byte) error {
+	salt, err := hex.DecodeString(block.Headers[saltHeader])
+	if err != nil || len(salt) != sizeSalt {
+		return errors.New("bad salt on encrypted key")
+	}
+	aead, err := passphraseAEAD(suite, passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	buf, err := aead.Open(nil, nonce, block.Bytes, []byte(block.Type))
+	if err != nil {
+		return errors.New("wrong passphrase")
+	}
+	block.Bytes = buf
+	delete(block.Headers, procTypeHeader)
+	delete(block.Headers, saltHeader)
+	return nil
+}
+
+func passphraseAEAD(suite CryptoSuite, passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	return suite.NewAEAD(key[:suite.KeySize()])
+}
+
+// EncryptKeys encrypts the private keys in doctrineHome that were stored
+// in the clear, the current one and the old one of a rotation, with a
+// passphrase from KeyPassphrase.
+func EncryptKeys(doctrineHome string) error {
+	var paths []string
+	for _, name := range []string{PrivateKeyFile, OldPrivateKeyFile} {
+		path := filepath.Join(doctrineHome, name)
+		block, err := readPEM(path)
+		if os.IsNotExist(err) && name == OldPrivateKeyFile {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if isEncrypted(block) {
+			return fmt.Errorf("%s is already encrypted", path)
+		}
+		paths = append(paths, path)
+	}
+
+	passphrase, err := KeyPassphrase.Get("New passphrase: ", true)
+	if err == ErrNoPassphrase || err == nil && len(passphrase) == 0 {
+		return errors.New("need a passphrase to encrypt with")
+	}
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		suite, privateKey, headers, err := readPrivateKeyFile(path, KeyPassphrase)
+		if err != nil {
+			return err
+		}
+		err = writeEncryptedKey(path, suite, privateKey, headers, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
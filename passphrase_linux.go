@@ -0,0 +1,28 @@
+//go:build linux
+
+package vuvuzela
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// readPassword reads a line from tty with echo turned off.
+func readPassword(tty *os.File) ([]byte, error) {
+	fd := tty.Fd()
+	var old syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old)))
+	if errno != 0 {
+		return readLine(tty)
+	}
+	noecho := old
+	noecho.Lflag &^= syscall.ECHO
+	syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&noecho)))
+	defer func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+		fmt.Fprintln(tty)
+	}()
+	return readLine(tty)
+}
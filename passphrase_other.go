@@ -0,0 +1,13 @@
+//go:build !linux
+
+package vuvuzela
+
+import (
+	"os"
+)
+
+// readPassword reads a line from tty. We do not know how to turn echo off
+// here, so the passphrase shows.
+func readPassword(tty *os.File) ([]byte, error) {
+	return readLine(tty)
+}
@@ -0,0 +1,121 @@
+package vuvuzela
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// PrivacyBudget is the differential privacy a conversation gets: over
+// Rounds rounds, what the servers can observe changes the odds of anything
+// by at most a factor of e^Epsilon, except with probability Delta.
+type PrivacyBudget struct {
+	Epsilon float64
+	Delta   float64
+	Rounds  int
+}
+
+// DefaultPrivacyBudget asks for about as much noise as a server can wrap
+// in onions within a round on one core with SM2. Servers with more to
+// spare should raise Rounds.
+var DefaultPrivacyBudget = PrivacyBudget{
+	Epsilon: 2,
+	Delta:   1e-4,
+	Rounds:  2,
+}
+
+// ConvoNoise is the noise a server adds to every conversation round. The
+// adversary sees how many dead drops are accessed once and how many
+// twice, so there is noise for both.
+type ConvoNoise struct {
+	// Single is how many noise messages go to dead drops of their own.
+	Single Laplace
+	// Double is how many pairs of noise messages go to a dead drop they
+	// share.
+	Double Laplace
+}
+
+// Calibrate derives the noise that gives the budget, following the
+// analysis of the Vuvuzela paper.
+//
+// A user that starts or stops talking in a round changes the number of
+// single access dead drops by at most 2 and the number of double access
+// dead drops by at most 1. Laplace noise of scale b and mean mu, cut off
+// at 0, hides a change of s with epsilon s/b, and fails to with
+// probability exp((s-mu)/b)/2. The budget of a round is split evenly
+// between the two counts, and the rounds are put together with the
+// advanced composition theorem, spending half of Delta on its slack.
+func (p PrivacyBudget) Calibrate() (ConvoNoise, error) {
+	if p.Epsilon <= 0 || math.IsInf(p.Epsilon, 0) || math.IsNaN(p.Epsilon) {
+		return ConvoNoise{}, fmt.Errorf("epsilon has to be positive, got %v", p.Epsilon)
+	}
+	if !(p.Delta > 0 && p.Delta < 1) {
+		return ConvoNoise{}, fmt.Errorf("delta has to be between 0 and 1, got %v", p.Delta)
+	}
+	if p.Rounds < 1 {
+		return ConvoNoise{}, fmt.Errorf("need at least 1 round, got %d", p.Rounds)
+	}
+
+	k := float64(p.Rounds)
+	epsilon := composeEpsilon(p.Epsilon, p.Delta/2, k)
+	// plain composition is better for a few rounds
+	epsilon = math.Max(epsilon, p.Epsilon/k)
+	delta := p.Delta / (2 * k)
+
+	half := func(sensitivity float64) Laplace {
+		b := sensitivity / (epsilon / 2)
+		return Laplace{
+			Mu: sensitivity + b*math.Log(1/delta),
+			B:  b,
+		}
+	}
+	return ConvoNoise{
+		Single: half(2),
+		Double: half(1),
+	}, nil
+}
+
+// composeEpsilon is the largest epsilon of a round such that k rounds
+// stay within total by the advanced composition theorem with slack.
+func composeEpsilon(total, slack, k float64) float64 {
+	composed := func(e float64) float64 {
+		return math.Sqrt(2*k*math.Log(1/slack))*e + k*e*math.Expm1(e)
+	}
+	lo, hi := 0.0, total
+	for i := 0; i < 100; i++ {
+		mid := (lo + hi) / 2
+		if composed(mid) > total {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return lo
+}
+
+// Verify checks that n is the noise calibrated for p, up to rounding.
+func (n ConvoNoise) Verify(p PrivacyBudget) error {
+	want, err := p.Calibrate()
+	if err != nil {
+		return err
+	}
+	for _, l := range [][2]Laplace{{n.Single, want.Single}, {n.Double, want.Double}} {
+		if !closeTo(l[0].Mu, l[1].Mu) || !closeTo(l[0].B, l[1].B) {
+			return errors.New("noise does not give the privacy budget")
+		}
+	}
+	return nil
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func (p PrivacyBudget) String() string {
+	return fmt.Sprintf("epsilon %g, delta %g over %d rounds", p.Epsilon, p.Delta, p.Rounds)
+}
+
+func (n ConvoNoise) String() string {
+	return fmt.Sprintf("single access mu %.1f b %.2f, double access mu %.1f b %.2f pairs",
+		n.Single.Mu, n.Single.B, n.Double.Mu, n.Double.B)
+}
@@ -0,0 +1,113 @@
+package vuvuzela
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ReplayWindow is how many rounds back a ReplayFilter remembers. Onions
+// for older rounds are turned away, as they could not be told apart from
+// replays anymore.
+const ReplayWindow = MaxRoundHistory
+
+var (
+	ErrReplay       = errors.New("onion already seen in this round")
+	ErrReplayStale  = errors.New("round too old to check for replays")
+	ErrReplayFuture = errors.New("round has not started yet")
+)
+
+// ReplayFilter remembers which onions a server opened in the recent
+// rounds of one kind. An onion is recognised by the reply key of our
+// layer: it is a hash of the layer's ephemeral key, so it is the same for
+// every copy of the onion and different for every other onion. Only
+// onions that opened should be checked, so garbage cannot fill it up.
+//
+// The window moves with Advance only, which is called with rounds we know
+// have started: the round a server opens itself, or a round the previous
+// hop sent over its authenticated link. The round of an onion is whatever
+// its sender says, so Check turns away onions for rounds past the window
+// instead of moving it.
+type ReplayFilter struct {
+	mu      sync.Mutex
+	rounds  map[uint32]map[string]bool
+	newest  uint32
+	replays int
+}
+
+func NewReplayFilter() *ReplayFilter {
+	return &ReplayFilter{
+		rounds: make(map[uint32]map[string]bool),
+	}
+}
+
+// Advance moves the window up to round, which has started, and forgets
+// the rounds that drop out of it.
+func (f *ReplayFilter) Advance(round uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if round <= f.newest {
+		return
+	}
+	f.newest = round
+	for r := range f.rounds {
+		if r+ReplayWindow < f.newest {
+			delete(f.rounds, r)
+		}
+	}
+}
+
+// Check records the onion known by id in round. It returns ErrReplay if
+// the onion was already seen in round, ErrReplayStale if round has
+// dropped out of the window, and ErrReplayFuture if the window has not
+// reached round yet.
+func (f *ReplayFilter) Check(round uint32, id []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if round > f.newest {
+		f.replays++
+		return ErrReplayFuture
+	}
+	if round+ReplayWindow < f.newest {
+		f.replays++
+		return ErrReplayStale
+	}
+	seen := f.rounds[round]
+	if seen == nil {
+		seen = make(map[string]bool)
+		f.rounds[round] = seen
+	}
+	if seen[string(id)] {
+		f.replays++
+		return ErrReplay
+	}
+	seen[string(id)] = true
+	return nil
+}
+
+// Replays is how many onions Check has turned away.
+func (f *ReplayFilter) Replays() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.replays
+}
+
+// newReplayFilters returns a filter for every kind of round.
+func newReplayFilters() map[byte]*ReplayFilter {
+	return map[byte]*ReplayFilter{
+		BatchConvo: NewReplayFilter(),
+		BatchDial:  NewReplayFilter(),
+	}
+}
+
+// replayed checks the onion known by id against filter and logs it if it
+// is turned away.
+func replayed(filter *ReplayFilter, round uint32, id []byte, from net.Addr) bool {
+	err := filter.Check(round, id)
+	if err == nil {
+		return false
+	}
+	fmt.Printf("drop onion from %s for round %d: %s (%d dropped so far)\n", from, round, err, filter.Replays())
+	return true
+}
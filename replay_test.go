@@ -0,0 +1,75 @@
+package vuvuzela
+
+import (
+	"testing"
+)
+
+func TestReplayFilter(t *testing.T) {
+	f := NewReplayFilter()
+	f.Advance(10)
+
+	if err := f.Check(10, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Check(10, []byte("a")); err != ErrReplay {
+		t.Fatalf("copy: got %v, want %v", err, ErrReplay)
+	}
+	if err := f.Check(9, []byte("a")); err != nil {
+		t.Fatalf("same onion id in an earlier round: %v", err)
+	}
+
+	f.Advance(10 + ReplayWindow + 1)
+	if err := f.Check(10, []byte("b")); err != ErrReplayStale {
+		t.Fatalf("round out of the window: got %v, want %v", err, ErrReplayStale)
+	}
+	if got := len(f.rounds); got != 0 {
+		t.Fatalf("remembers %d rounds out of the window", got)
+	}
+}
+
+// A client can seal an onion for any round it likes. Such onions must not
+// move the window, or every onion of the real rounds would be stale.
+func TestReplayFilterFutureRound(t *testing.T) {
+	f := NewReplayFilter()
+	f.Advance(11)
+
+	if err := f.Check(100000, []byte("evil")); err != ErrReplayFuture {
+		t.Fatalf("round far ahead: got %v, want %v", err, ErrReplayFuture)
+	}
+	if err := f.Check(12, []byte("early")); err != ErrReplayFuture {
+		t.Fatalf("next round: got %v, want %v", err, ErrReplayFuture)
+	}
+	if err := f.Check(11, []byte("honest")); err != nil {
+		t.Fatalf("open round after a round far ahead: %v", err)
+	}
+	if len(f.rounds) != 1 {
+		t.Fatalf("recorded %d rounds, want 1", len(f.rounds))
+	}
+}
+
+func TestRoundManagerReplays(t *testing.T) {
+	clock := newFakeClock()
+	m := newTestRoundManager(clock, func(*Round) error { return nil })
+	m.Replays = NewReplayFilter()
+
+	for i := 0; i < 12; i++ {
+		m.Next()
+	}
+	open := uint32(11)
+	evil := &envelope{replyKey: []byte("evil")}
+	if _, ok := m.Submit(open+1000, evil).(RoundError); !ok {
+		t.Fatal("took a message for a round that is not open")
+	}
+	honest := &envelope{replyKey: []byte("honest")}
+	if err := m.Submit(open, honest); err != nil {
+		t.Fatalf("message for the open round: %v", err)
+	}
+	if err := m.Submit(open, honest); err != ErrReplay {
+		t.Fatalf("copy of a message: got %v, want %v", err, ErrReplay)
+	}
+
+	m.Next()
+	if err := m.Submit(open+1, honest); err != nil {
+		t.Fatalf("same message in the next round: %v", err)
+	}
+}
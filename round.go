@@ -0,0 +1,44 @@
+package vuvuzela
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RoundError is returned for a message made for a round other than the
+// one it arrived in, e.g. because it was late.
+type RoundError struct {
+	Round   uint32
+	Current int
+}
+
+func (err RoundError) Error() string {
+	return fmt.Sprintf("message for round %d arrived in round %d", err.Round, err.Current)
+}
+
+// announceRound tells every client that r has opened.
+func (s *Server) announceRound(r *Round) {
+	s.announce(r.Kind, r.Number, r.Deadline)
+}
+
+// announce tells every client that a round of kind is open and takes
+// messages until deadline.
+func (s *Server) announce(kind byte, round uint32, deadline time.Time) {
+	msg := make([]byte, 1+SizeRound+SizeDeadline)
+	msg[0] = kind
+	binary.BigEndian.PutUint32(msg[1:], round)
+	binary.BigEndian.PutUint64(msg[1+SizeRound:], uint64(deadline.UnixNano()))
+
+	s.connLock.RLock()
+	defer s.connLock.RUnlock()
+	for conn := range s.connMap {
+		go func(conn net.Conn) {
+			err := tell(conn, FrameAnnouncement, msg)
+			if err != nil {
+				fmt.Printf("announce round error: %s\n", err)
+			}
+		}(conn)
+	}
+}
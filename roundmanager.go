@@ -0,0 +1,229 @@
+package vuvuzela
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type RoundState int
+
+const (
+	RoundOpen RoundState = iota
+	RoundClosed
+	RoundMixing
+	RoundForwarded
+	RoundFailed
+)
+
+const (
+	MaxRoundSize    = 1 << 16
+	MaxRoundHistory = 64
+)
+
+var (
+	ErrRoundFull     = errors.New("round is full")
+	ErrRoundDeadline = errors.New("round deadline has passed")
+)
+
+func (s RoundState) String() string {
+	switch s {
+	case RoundOpen:
+		return "open"
+	case RoundClosed:
+		return "closed"
+	case RoundMixing:
+		return "mixing"
+	case RoundForwarded:
+		return "forwarded"
+	case RoundFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("RoundState(%d)", int(s))
+}
+
+// Round is one round of a RoundManager and the messages submitted to it.
+type Round struct {
+	Kind     byte
+	Number   uint32
+	Deadline time.Time
+
+	state    RoundState
+	messages []*envelope
+	metrics  RoundMetrics
+}
+
+// RoundMetrics is what a RoundManager remembers about a round.
+type RoundMetrics struct {
+	Number    uint32
+	State     RoundState
+	Messages  int
+	Rejected  int
+	Opened    time.Time
+	Closed    time.Time
+	Forwarded time.Time
+}
+
+// RoundManager owns the lifecycle of the rounds of one kind: a round
+// takes messages while open, is closed at its deadline, then handed to
+// the mix function and finally forwarded down the chain. Only one round
+// is open at a time. The clock is injectable so rounds can be driven
+// without waiting on real time.
+type RoundManager struct {
+	Kind    byte
+	Delay   time.Duration
+	MaxSize int
+	Now     func() time.Time
+	// Mix is called with every closed round, in its own goroutine. The
+	// round is marked forwarded when Mix returns nil, failed otherwise.
+	Mix func(*Round) error
+	// Replays, if set, turns away copies of a message, known by its
+	// reply key. Its window moves with the rounds Next opens.
+	Replays *ReplayFilter
+
+	mu      sync.Mutex
+	current *Round
+	next    uint32
+	history []*Round
+}
+
+func NewRoundManager(kind byte, delay time.Duration, mix func(*Round) error) *RoundManager {
+	return &RoundManager{
+		Kind:    kind,
+		Delay:   delay,
+		MaxSize: MaxRoundSize,
+		Now:     time.Now,
+		Mix:     mix,
+	}
+}
+
+// Submit adds a message to round, which must be the open round and still
+// before its deadline, unless Replays has seen it already.
+func (m *RoundManager) Submit(round uint32, e *envelope) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.current
+	if r == nil || r.Number != round {
+		current := -1
+		if r != nil {
+			current = int(r.Number)
+			r.metrics.Rejected++
+		}
+		return RoundError{round, current}
+	}
+	if m.Now().After(r.Deadline) {
+		r.metrics.Rejected++
+		return ErrRoundDeadline
+	}
+	if len(r.messages) >= m.MaxSize {
+		r.metrics.Rejected++
+		return ErrRoundFull
+	}
+	// only messages for the open round get this far, so the filter
+	// records nothing for rounds a client made up
+	if m.Replays != nil {
+		err := m.Replays.Check(round, e.replyKey)
+		if err != nil {
+			r.metrics.Rejected++
+			return err
+		}
+	}
+	r.messages = append(r.messages, e)
+	return nil
+}
+
+// Next closes the open round, hands it to Mix and opens the next round,
+// which is returned.
+func (m *RoundManager) Next() *Round {
+	now := m.Now()
+	r := &Round{
+		Kind:     m.Kind,
+		Number:   m.next,
+		Deadline: now.Add(m.Delay),
+		state:    RoundOpen,
+	}
+	r.metrics.Opened = now
+
+	m.mu.Lock()
+	closed := m.current
+	if closed != nil {
+		closed.state = RoundClosed
+		closed.metrics.Closed = now
+		closed.metrics.Messages = len(closed.messages)
+	}
+	m.current = r
+	m.next++
+	if m.Replays != nil {
+		m.Replays.Advance(r.Number)
+	}
+	m.history = append(m.history, r)
+	if len(m.history) > MaxRoundHistory {
+		m.history = m.history[len(m.history)-MaxRoundHistory:]
+	}
+	m.mu.Unlock()
+
+	if closed != nil {
+		go m.mix(closed)
+	}
+	return r
+}
+
+func (m *RoundManager) mix(r *Round) {
+	m.setState(r, RoundMixing)
+	err := m.Mix(r)
+	if err != nil {
+		fmt.Printf("round %d of kind %d failed: %s\n", r.Number, m.Kind, err)
+		m.setState(r, RoundFailed)
+		return
+	}
+	m.setState(r, RoundForwarded)
+
+	m.mu.Lock()
+	metrics := r.metrics
+	m.mu.Unlock()
+	fmt.Printf("round %d of kind %d: %d messages, %d rejected, forwarded %s after close\n",
+		r.Number, m.Kind, metrics.Messages, metrics.Rejected, metrics.Forwarded.Sub(metrics.Closed))
+}
+
+func (m *RoundManager) setState(r *Round, state RoundState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.state = state
+	if state == RoundForwarded {
+		r.metrics.Forwarded = m.Now()
+	}
+}
+
+// Messages returns the messages of a round that is no longer open.
+func (r *Round) Messages() []*envelope {
+	return r.messages
+}
+
+// Run opens a new round on every tick until tick is closed, calling
+// opened with each new round.
+func (m *RoundManager) Run(tick <-chan time.Time, opened func(*Round)) {
+	for range tick {
+		r := m.Next()
+		if opened != nil {
+			opened(r)
+		}
+	}
+}
+
+// Metrics returns what is known about the most recent rounds, oldest
+// first.
+func (m *RoundManager) Metrics() []RoundMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metrics := make([]RoundMetrics, len(m.history))
+	for i, r := range m.history {
+		metrics[i] = r.metrics
+		metrics[i].Number = r.Number
+		metrics[i].State = r.state
+		if r.state == RoundOpen {
+			metrics[i].Messages = len(r.messages)
+		}
+	}
+	return metrics
+}
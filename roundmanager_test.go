@@ -0,0 +1,188 @@
+package vuvuzela
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestRoundManager(clock *fakeClock, mix func(*Round) error) *RoundManager {
+	m := NewRoundManager(BatchConvo, time.Second, mix)
+	m.Now = clock.Now
+	return m
+}
+
+// waitState waits for round n of m to reach state.
+func waitState(t *testing.T, m *RoundManager, n uint32, state RoundState) RoundMetrics {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, metrics := range m.Metrics() {
+			if metrics.Number == n && metrics.State == state {
+				return metrics
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("round %d never became %s: %+v", n, state, m.Metrics())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRoundManagerSubmit(t *testing.T) {
+	clock := newFakeClock()
+	m := newTestRoundManager(clock, func(*Round) error { return nil })
+
+	err := m.Submit(0, &envelope{})
+	if err != (RoundError{Round: 0, Current: -1}) {
+		t.Fatalf("submit before the first round: got %v", err)
+	}
+
+	r := m.Next()
+	if r.Number != 0 || !r.Deadline.Equal(clock.Now().Add(time.Second)) {
+		t.Fatalf("first round is %d with deadline %s", r.Number, r.Deadline)
+	}
+	if err := m.Submit(0, &envelope{}); err != nil {
+		t.Fatalf("submit to the open round: %s", err)
+	}
+
+	err = m.Submit(1, &envelope{})
+	if err != (RoundError{Round: 1, Current: 0}) {
+		t.Fatalf("submit to a later round: got %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if err := m.Submit(0, &envelope{}); err != nil {
+		t.Fatalf("submit right at the deadline: %s", err)
+	}
+	clock.Advance(time.Nanosecond)
+	if err := m.Submit(0, &envelope{}); err != ErrRoundDeadline {
+		t.Fatalf("late submit: got %v, want %v", err, ErrRoundDeadline)
+	}
+
+	m.Next()
+	err = m.Submit(0, &envelope{})
+	if err != (RoundError{Round: 0, Current: 1}) {
+		t.Fatalf("submit to a closed round: got %v", err)
+	}
+}
+
+func TestRoundManagerFull(t *testing.T) {
+	clock := newFakeClock()
+	m := newTestRoundManager(clock, func(*Round) error { return nil })
+	m.MaxSize = 2
+
+	m.Next()
+	for i := 0; i < m.MaxSize; i++ {
+		if err := m.Submit(0, &envelope{}); err != nil {
+			t.Fatalf("submit %d: %s", i, err)
+		}
+	}
+	if err := m.Submit(0, &envelope{}); err != ErrRoundFull {
+		t.Fatalf("submit to a full round: got %v, want %v", err, ErrRoundFull)
+	}
+}
+
+func TestRoundManagerStates(t *testing.T) {
+	clock := newFakeClock()
+	mixing := make(chan *Round)
+	release := make(chan error)
+	m := newTestRoundManager(clock, func(r *Round) error {
+		mixing <- r
+		return <-release
+	})
+
+	m.Next()
+	m.Submit(0, &envelope{})
+	m.Submit(0, &envelope{})
+	m.Submit(1, &envelope{})
+	if got := waitState(t, m, 0, RoundOpen); got.Messages != 2 || got.Rejected != 1 {
+		t.Fatalf("open round metrics: %+v", got)
+	}
+
+	clock.Advance(time.Second)
+	closedAt := clock.Now()
+	m.Next()
+	r := <-mixing
+	if r.Number != 0 || len(r.Messages()) != 2 {
+		t.Fatalf("mixing round %d with %d messages", r.Number, len(r.Messages()))
+	}
+	got := waitState(t, m, 0, RoundMixing)
+	if !got.Closed.Equal(closedAt) || got.Messages != 2 {
+		t.Fatalf("mixing round metrics: %+v", got)
+	}
+	waitState(t, m, 1, RoundOpen)
+
+	clock.Advance(300 * time.Millisecond)
+	release <- nil
+	got = waitState(t, m, 0, RoundForwarded)
+	if got.Forwarded.Sub(got.Closed) != 300*time.Millisecond {
+		t.Fatalf("forwarded %s after close", got.Forwarded.Sub(got.Closed))
+	}
+
+	clock.Advance(time.Second)
+	m.Next()
+	<-mixing
+	release <- errors.New("next hop is down")
+	got = waitState(t, m, 1, RoundFailed)
+	if !got.Forwarded.IsZero() {
+		t.Fatalf("failed round has forward time %s", got.Forwarded)
+	}
+}
+
+func TestRoundManagerMetrics(t *testing.T) {
+	clock := newFakeClock()
+	m := newTestRoundManager(clock, func(*Round) error { return nil })
+
+	start := clock.Now()
+	for i := 0; i < MaxRoundHistory+10; i++ {
+		m.Next()
+		for j := 0; j < i%3; j++ {
+			m.Submit(uint32(i), &envelope{})
+		}
+		clock.Advance(time.Second)
+	}
+
+	metrics := m.Metrics()
+	if len(metrics) != MaxRoundHistory {
+		t.Fatalf("kept %d rounds, want %d", len(metrics), MaxRoundHistory)
+	}
+	for i, got := range metrics {
+		n := uint32(i + 10)
+		if got.Number != n {
+			t.Fatalf("metrics[%d] is round %d, want %d", i, got.Number, n)
+		}
+		if got.Messages != int(n%3) {
+			t.Errorf("round %d has %d messages, want %d", n, got.Messages, n%3)
+		}
+		if want := start.Add(time.Duration(n) * time.Second); !got.Opened.Equal(want) {
+			t.Errorf("round %d opened at %s, want %s", n, got.Opened, want)
+		}
+	}
+	if last := metrics[len(metrics)-1]; last.State != RoundOpen || !last.Closed.IsZero() {
+		t.Fatalf("newest round: %+v", last)
+	}
+}
@@ -0,0 +1,413 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatingDeadline time.Duration = 4 * time.Second
+)
+
+// DownstreamRefresh is how often a server fetches the doctrines of the
+// servers after it again, to pick up their rotated keys. Rotated keys have
+// to keep working for longer than this.
+const DownstreamRefresh = 10 * time.Minute
+
+// Server is a mix server of the chain: the entry server clients connect
+// to when Hop is 0, otherwise a server between the entry server and the
+// last one.
+type Server struct {
+	Topology *Topology
+	Hop      int
+	Suite    CryptoSuite
+	Keys     *KeyRing
+	// Noise is the noise added to every conversation round, calibrated
+	// for DefaultPrivacyBudget unless set otherwise.
+	Noise ConvoNoise
+	// ConvoNoisePool and DialNoisePool wrap the noise of upcoming rounds
+	// ahead of time. They can be tuned before ListenAndServe.
+	ConvoNoisePool *NoisePool
+	DialNoisePool  *NoisePool
+
+	self    *ServerInfo
+	nextHop *ServerInfo
+	inSize  int
+	// downstream has the public keys of the servers after us in chain
+	// order, to wrap noise in.
+	downMu     sync.RWMutex
+	downstream []PublicKey
+	root       *RootKey
+	next       *nextHopLink
+
+	connLock sync.RWMutex
+	connMap  map[net.Conn]PublicKey
+
+	replays map[byte]*ReplayFilter
+
+	convoRounds *RoundManager
+	dialRounds  *RoundManager
+}
+
+// NewServer sets up the server at position hop of topology. It fetches
+// the public key of the next hop from its doctrine, which has to be
+// signed by root, so the next hop has to be up, and it has to run the
+// same crypto suite as keys.
+func NewServer(topology *Topology, hop int, keys *KeyRing, root *RootKey) (*Server, error) {
+	suite := keys.Suite
+	if hop < 0 || hop >= len(topology.Servers)-1 {
+		return nil, fmt.Errorf("hop %d out of range: the chain has %d mix servers before the last one", hop, len(topology.Servers)-1)
+	}
+	s := &Server{
+		Topology: topology,
+		Hop:      hop,
+		Suite:    suite,
+		Keys:     keys,
+		self:     topology.Servers[hop],
+		nextHop:  topology.Servers[hop+1],
+		inSize:   OnionSize(suite, len(topology.Servers)-hop),
+		connMap:  make(map[net.Conn]PublicKey),
+		replays:  newReplayFilters(),
+		root:     root,
+	}
+	var err error
+	s.downstream, err = s.fetchDownstream()
+	if err != nil {
+		return nil, err
+	}
+	s.next = newNextHopLink(topology, hop, keys, s.downstream[0])
+	s.Noise, err = DefaultPrivacyBudget.Calibrate()
+	if err != nil {
+		return nil, err
+	}
+	s.ConvoNoisePool = NewNoisePool(BatchConvo, s.convoNoise, s.noiseOnion)
+	s.DialNoisePool = NewNoisePool(BatchDial, s.dialNoise, s.noiseOnion)
+	s.convoRounds = NewRoundManager(BatchConvo, RoundDelay, s.roundend)
+	s.convoRounds.Replays = s.replays[BatchConvo]
+	s.dialRounds = NewRoundManager(BatchDial, DialRoundDelay, s.dialroundend)
+	s.dialRounds.Replays = s.replays[BatchDial]
+	return s, nil
+}
+
+// ListenAndServe takes messages on the server's message address until
+// accepting a connection fails.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", ListenAddr(s.self.MessageAddr))
+	if err != nil {
+		return err
+	}
+	// only the entry server keeps time, the rest of the chain mixes each
+	// round as it arrives from the previous hop.
+	if s.Hop == 0 {
+		go s.convoRounds.Run(time.NewTicker(RoundDelay).C, s.announceRound)
+		go s.dialRounds.Run(time.NewTicker(DialRoundDelay).C, s.announceRound)
+	}
+	go s.refreshDownstream(time.NewTicker(DownstreamRefresh).C)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if s.Hop == 0 {
+			go s.inConn(conn)
+		} else {
+			go s.hopConn(conn)
+		}
+	}
+}
+
+func (s *Server) inConn(conn net.Conn) {
+	kind, round, onion, err := s.readMessageFromConn(conn)
+	if err != nil {
+		return
+	}
+	if kind != Register {
+		return
+	}
+	if !s.register(conn, round, onion) {
+		return
+	}
+
+	for {
+		kind, round, onion, err := s.readMessageFromConn(conn)
+		if err != nil {
+			s.removeConn(conn)
+			return
+		}
+		go s.divertMessage(kind, round, onion, conn)
+	}
+}
+
+func (s *Server) readMessageFromConn(conn net.Conn) (byte, uint32, []byte, error) {
+	err := conn.SetReadDeadline(time.Now().Add(heartbeatingDeadline))
+	if err != nil {
+		fmt.Println("set deadline err: ", err)
+		return 0, 0, nil, err
+	}
+	// clients are not registered yet, so they get no more room than
+	// one onion
+	buf, err := ExpectFrame(conn, FrameOnion, SizeOnionHeader+s.inSize)
+	if err != nil {
+		if hearterr, ok := err.(net.Error); ok && hearterr.Timeout() {
+			fmt.Println("conn's heart stopped")
+		} else if err != io.EOF {
+			fmt.Println("conn read error:", err)
+		}
+		return 0, 0, nil, err
+	}
+	kind, round, onion, err := ParseOnion(buf)
+	if err == nil && len(onion) != s.inSize {
+		err = fmt.Errorf("read conn msg length error: expected %d bytes, received %d bytes", s.inSize, len(onion))
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 0, 0, nil, err
+	}
+	return kind, round, onion, nil
+}
+
+// register opens the onion a client introduces itself with and remembers
+// the client's public key for as long as it stays connected.
+func (s *Server) register(conn net.Conn, round uint32, onion []byte) bool {
+	msg, _, err := s.Keys.OpenLayer(Register, round, onion)
+	if err != nil {
+		fmt.Println("open register onion error:", err)
+		return false
+	}
+	publicKey, err := s.Suite.ParsePublicKey(msg[:s.Suite.PublicKeySize()])
+	if err != nil {
+		fmt.Println("parse publickey err: ", err)
+		return false
+	}
+	s.connLock.Lock()
+	s.connMap[conn] = publicKey
+	s.connLock.Unlock()
+	return true
+}
+
+func (s *Server) divertMessage(kind byte, round uint32, onion []byte, conn net.Conn) {
+	if kind == Register {
+		if !s.register(conn, round, onion) {
+			s.removeConn(conn)
+		}
+		return
+	}
+	if _, ok := s.replays[kind]; !ok {
+		fmt.Printf("unknown onion kind %d from %s\n", kind, conn.RemoteAddr())
+		return
+	}
+	inner, replyKey, err := s.Keys.OpenLayer(kind, round, onion)
+	if err != nil {
+		fmt.Printf("open onion from %s error: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	// the round managers turn away replays, once they know the round is
+	// open
+	switch kind {
+	case BatchConvo:
+		err = s.convoRounds.Submit(round, &envelope{msg: inner, replyKey: replyKey, conn: conn})
+		if err != nil {
+			fmt.Printf("reject message from %s: %s\n", conn.RemoteAddr(), err)
+		}
+	case BatchDial:
+		err = s.dialRounds.Submit(round, &envelope{msg: inner, replyKey: replyKey, conn: conn})
+		if err != nil {
+			fmt.Printf("reject invitation from %s: %s\n", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// hopConn takes the link the previous server in the chain opens, and
+// handles the rounds it forwards over it.
+func (s *Server) hopConn(conn net.Conn) {
+	defer conn.Close()
+	link, err := acceptHop(conn, s.Topology, s.Hop, s.Keys, s.root)
+	if err != nil {
+		fmt.Printf("refuse link from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	for {
+		kind, round, onions, err := link.ReadBatch(FrameBatch, s.inSize)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("read batch error:", err)
+			}
+			return
+		}
+		// the previous hop vouches for the round, so it may move the
+		// replay window
+		if filter, ok := s.replays[kind]; ok {
+			filter.Advance(round)
+		}
+		switch kind {
+		case BatchConvo:
+			go s.hopConvo(link, round, onions)
+		case BatchDial:
+			go s.hopDial(link, round, onions)
+		default:
+			fmt.Printf("unknown batch kind %d\n", kind)
+		}
+	}
+}
+
+// hopConvo peels our layer off every message of a conversation round,
+// mixes the batch down the chain and sends the replies back in the order
+// the messages came in.
+func (s *Server) hopConvo(link *hopLink, round uint32, onions [][]byte) {
+	var batch, replyKeys [][]byte
+	var positions []int
+	for i, onion := range onions {
+		// noise and onions made for another round do not open, and
+		// copies of an onion we already opened are treated the same
+		inner, replyKey, err := s.Keys.OpenLayer(BatchConvo, round, onion)
+		if err != nil || replayed(s.replays[BatchConvo], round, replyKey, link.RemoteAddr()) {
+			continue
+		}
+		batch = append(batch, inner)
+		replyKeys = append(replyKeys, replyKey)
+		positions = append(positions, i)
+	}
+
+	mixed, err := s.mix(round, batch)
+	if err != nil {
+		fmt.Printf("mix round %d error: %s\n", round, err)
+		err = link.WriteFailure(BatchConvo, round, err)
+		if err != nil {
+			fmt.Println("write failure error:", err)
+		}
+		return
+	}
+	// onions we could not open get random bytes, which look the same as
+	// a sealed reply to the previous hop.
+	size := ReplySize(len(s.Topology.Servers) - s.Hop)
+	replies := make([][]byte, len(onions))
+	for i := range replies {
+		replies[i] = RandomReply(size)
+	}
+	for i, position := range positions {
+		sealed, err := SealReply(s.Suite, replyKeys[i], mixed[i])
+		if err != nil {
+			fmt.Printf("seal reply error: %s\n", err)
+			continue
+		}
+		replies[position] = sealed
+	}
+	err = link.WriteBatch(FrameReplies, BatchConvo, round, replies)
+	if err != nil {
+		fmt.Println("write replies error:", err)
+	}
+}
+
+// reply sends a client the reply to the message it submitted in round,
+// sealed under the reply key of the client's outermost layer.
+func (s *Server) reply(conn net.Conn, round uint32, replyKey, msg []byte) {
+	s.connLock.RLock()
+	_, ok := s.connMap[conn]
+	s.connLock.RUnlock()
+	if !ok {
+		return
+	}
+	sealed, err := SealReply(s.Suite, replyKey, msg)
+	if err != nil {
+		fmt.Printf("seal reply error: %s\n", err)
+		return
+	}
+	err = tell(conn, FrameReply, EncodeBatch(BatchConvo, round, [][]byte{sealed}))
+	if err != nil {
+		fmt.Printf("tell error: %s\n", err)
+	}
+}
+
+func (s *Server) removeConn(conn net.Conn) {
+	s.connLock.Lock()
+	delete(s.connMap, conn)
+	s.connLock.Unlock()
+}
+
+func (s *Server) broadcast(typ byte, msg []byte) {
+	s.connLock.RLock()
+	defer s.connLock.RUnlock()
+	for conn, publicKey := range s.connMap {
+		go func(conn net.Conn, publicKey PublicKey) {
+			sealed, _, err := s.Suite.SealLayer(publicKey, []byte{typ}, msg)
+			if err != nil {
+				fmt.Printf("encrypt error: %s\n", err)
+				return
+			}
+			tell(conn, typ, sealed)
+		}(conn, publicKey)
+	}
+}
+
+func tell(conn net.Conn, typ byte, msg []byte) error {
+	return WriteFrame(conn, typ, msg)
+}
+
+// noiseOnion wraps body in a layer for every server after us, for round
+// of kind. Noise opens all the way down the chain like the onions of
+// clients, so no server after us can tell it apart from them.
+func (s *Server) noiseOnion(kind byte, round uint32, body []byte) ([]byte, error) {
+	s.downMu.RLock()
+	downstream := s.downstream
+	s.downMu.RUnlock()
+	onion, _, err := WrapOnion(s.Suite, downstream, kind, round, body)
+	return onion, err
+}
+
+// fetchDownstream fetches the public keys of the servers after us from
+// their doctrines, in chain order.
+func (s *Server) fetchDownstream() ([]PublicKey, error) {
+	var downstream []PublicKey
+	for i := s.Hop + 1; i < len(s.Topology.Servers); i++ {
+		server := s.Topology.Servers[i]
+		suite, publicKey, err := FetchServerKey(s.root, s.Topology, i)
+		if err != nil {
+			return nil, fmt.Errorf("fetch publickey of %s: %s", server.Name, err)
+		}
+		if suite != s.Suite {
+			return nil, fmt.Errorf("%s runs crypto suite %s, we run %s", server.Name, suite.Name(), s.Suite.Name())
+		}
+		downstream = append(downstream, publicKey)
+	}
+	return downstream, nil
+}
+
+// RefreshDownstream fetches the keys of the servers after us again. If one
+// of them rotated its key, noise is wrapped and the next hop is greeted
+// with the new keys from now on. The old keys keep working until the
+// servers retire them, so noise already wrapped still opens.
+func (s *Server) RefreshDownstream() error {
+	downstream, err := s.fetchDownstream()
+	if err != nil {
+		return err
+	}
+	s.downMu.Lock()
+	changed := false
+	for i, publicKey := range downstream {
+		if !bytes.Equal(publicKey.Bytes(), s.downstream[i].Bytes()) {
+			fmt.Printf("%s has a new key\n", s.Topology.Servers[s.Hop+1+i].Name)
+			changed = true
+		}
+	}
+	s.downstream = downstream
+	s.downMu.Unlock()
+	if changed {
+		s.next.SetKey(downstream[0])
+	}
+	return nil
+}
+
+// refreshDownstream calls RefreshDownstream on every tick.
+func (s *Server) refreshDownstream(tick <-chan time.Time) {
+	for range tick {
+		err := s.RefreshDownstream()
+		if err != nil {
+			fmt.Printf("refresh downstream keys error: %s\n", err)
+		}
+	}
+}
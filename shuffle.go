@@ -0,0 +1,36 @@
+package vuvuzela
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// Shuffle applies a uniformly random permutation to msgs in place, using
+// crypto/rand so the order a round leaves in says nothing about the order
+// its messages arrived in. The returned permutation maps each output
+// position to the input position it came from, msgs[i] = in[perm[i]].
+func Shuffle(msgs [][]byte) ([]int, error) {
+	perm := make([]int, len(msgs))
+	for i := range perm {
+		perm[i] = i
+	}
+	for i := len(msgs) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return nil, err
+		}
+		k := j.Int64()
+		msgs[i], msgs[k] = msgs[k], msgs[i]
+		perm[i], perm[k] = perm[k], perm[i]
+	}
+	return perm, nil
+}
+
+// Unshuffle undoes Shuffle on the replies to a shuffled batch.
+func Unshuffle(msgs [][]byte, perm []int) [][]byte {
+	out := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		out[perm[i]] = msg
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestShuffleUniform(t *testing.T) {
+	const n = 5
+	const trials = 50000
+
+	var counts [n][n]int
+	for trial := 0; trial < trials; trial++ {
+		msgs := make([][]byte, n)
+		for i := range msgs {
+			msgs[i] = []byte{byte(i)}
+		}
+		if _, err := Shuffle(msgs); err != nil {
+			t.Fatal(err)
+		}
+		for out, msg := range msgs {
+			counts[msg[0]][out]++
+		}
+	}
+
+	// every input position should land in every output position about
+	// trials/n times: allow 6 standard deviations
+	want := float64(trials) / n
+	slack := 6 * math.Sqrt(want*(1-1.0/n))
+	for in := range counts {
+		for out, got := range counts[in] {
+			if math.Abs(float64(got)-want) > slack {
+				t.Errorf("input %d went to output %d %d times, want %.0f ± %.0f", in, out, got, want, slack)
+			}
+		}
+	}
+}
+
+func TestUnshuffle(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 17, 1000} {
+		in := make([][]byte, n)
+		for i := range in {
+			in[i] = []byte{byte(i), byte(i >> 8)}
+		}
+		msgs := append([][]byte(nil), in...)
+		perm, err := Shuffle(msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range msgs {
+			if !bytes.Equal(msgs[i], in[perm[i]]) {
+				t.Fatalf("n=%d: msgs[%d] is not in[perm[%d]]", n, i, i)
+			}
+		}
+		out := Unshuffle(msgs, perm)
+		for i := range out {
+			if !bytes.Equal(out[i], in[i]) {
+				t.Fatalf("n=%d: Unshuffle(Shuffle(x))[%d] = %v, want %v", n, i, out[i], in[i])
+			}
+		}
+	}
+}
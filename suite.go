@@ -0,0 +1,80 @@
+package vuvuzela
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+)
+
+// A CryptoSuite is the set of primitives a network is built on. Every
+// server of a network advertises the same suite in its doctrine and the
+// client uses whatever the servers advertise, so one code base runs both
+// on the Chinese national standards and on Curve25519 and NaCl.
+type CryptoSuite interface {
+	// Name is how the suite is named in doctrines.
+	Name() string
+
+	GenerateKey() (PrivateKey, error)
+	// ParsePublicKey and ParsePrivateKey take what Bytes returns.
+	ParsePublicKey(buf []byte) (PublicKey, error)
+	ParsePrivateKey(buf []byte) (PrivateKey, error)
+	// PEMTypes are the PEM block types keys of the suite are stored
+	// under.
+	PEMTypes() (publicKey, privateKey string)
+	PublicKeySize() int
+
+	// SealLayer seals payload for the owner of publicKey with a fresh
+	// ephemeral key, bound to ad. It also returns a key only the owner
+	// of publicKey can derive from the layer, which is used to seal the
+	// reply to it. OpenLayer undoes SealLayer.
+	SealLayer(publicKey PublicKey, ad, payload []byte) (layer, replyKey []byte, err error)
+	OpenLayer(privateKey PrivateKey, ad, layer []byte) (payload, replyKey []byte, err error)
+	// LayerOverhead is how much longer SealLayer makes a payload.
+	LayerOverhead() int
+
+	// SharedSecret is the secret the owners of privateKey and peer agree
+	// on without talking.
+	SharedSecret(privateKey PrivateKey, peer PublicKey) ([]byte, error)
+	// NewAEAD returns the suite's authenticated cipher under key, which
+	// is KeySize bytes long. Its nonces are SizeNonce bytes and its tags
+	// SizeTag bytes.
+	NewAEAD(key []byte) (cipher.AEAD, error)
+	KeySize() int
+	Hash(data []byte) []byte
+
+	Sign(privateKey PrivateKey, msg []byte) ([]byte, error)
+	Verify(publicKey PublicKey, msg, signature []byte) bool
+}
+
+// PublicKey is a public key of some CryptoSuite.
+type PublicKey interface {
+	// Bytes is the key as it goes on the wire.
+	Bytes() []byte
+}
+
+// PrivateKey is a private key of some CryptoSuite.
+type PrivateKey interface {
+	Bytes() []byte
+	Public() PublicKey
+}
+
+var errWrongSuite = errors.New("key is from another crypto suite")
+
+// DefaultSuite is the suite of doctrines that do not name one.
+var DefaultSuite CryptoSuite = SM2Suite
+
+// Suites are the suites a doctrine may name.
+var Suites = []CryptoSuite{SM2Suite, X25519Suite}
+
+// SuiteByName returns the suite called name.
+func SuiteByName(name string) (CryptoSuite, error) {
+	if name == "" {
+		return DefaultSuite, nil
+	}
+	for _, suite := range Suites {
+		if suite.Name() == name {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown crypto suite %q", name)
+}
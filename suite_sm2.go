@@ -0,0 +1,203 @@
+package vuvuzela
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"math/big"
+
+	"github.com/tjfoc/gmsm/sm2"
+	"github.com/tjfoc/gmsm/sm3"
+	"github.com/tjfoc/gmsm/sm4"
+)
+
+const (
+	sm2PublicKeyLength = 91
+	sm2EphemeralKey    = 64
+	sm2KeySize         = 16
+)
+
+// SM2Suite builds a network on the Chinese national standards: SM2 for
+// key agreement and signatures, SM3 for hashing and SM4-GCM for sealing.
+// Keys are stored the way gmsm stores them.
+var SM2Suite CryptoSuite = sm2Suite{}
+
+type sm2Suite struct{}
+
+type sm2PublicKey struct {
+	key *sm2.PublicKey
+	der []byte
+}
+
+type sm2PrivateKey struct {
+	key    *sm2.PrivateKey
+	der    []byte
+	public *sm2PublicKey
+}
+
+func (k *sm2PublicKey) Bytes() []byte      { return k.der }
+func (k *sm2PrivateKey) Bytes() []byte     { return k.der }
+func (k *sm2PrivateKey) Public() PublicKey { return k.public }
+
+func (sm2Suite) Name() string { return "sm2" }
+
+func (s sm2Suite) GenerateKey() (PrivateKey, error) {
+	key, err := sm2.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return newSM2PrivateKey(key)
+}
+
+func newSM2PrivateKey(key *sm2.PrivateKey) (*sm2PrivateKey, error) {
+	der, err := sm2.MarshalSm2UnecryptedPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	public, err := newSM2PublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sm2PrivateKey{key: key, der: der, public: public}, nil
+}
+
+func newSM2PublicKey(key *sm2.PublicKey) (*sm2PublicKey, error) {
+	der, err := sm2.MarshalSm2PublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sm2PublicKey{key: key, der: der}, nil
+}
+
+func (sm2Suite) ParsePublicKey(buf []byte) (PublicKey, error) {
+	key, err := sm2.ParseSm2PublicKey(buf)
+	if err != nil {
+		return nil, err
+	}
+	return newSM2PublicKey(key)
+}
+
+func (sm2Suite) ParsePrivateKey(buf []byte) (PrivateKey, error) {
+	key, err := sm2.ParsePKCS8UnecryptedPrivateKey(buf)
+	if err != nil {
+		return nil, err
+	}
+	return newSM2PrivateKey(key)
+}
+
+func (sm2Suite) PEMTypes() (string, string) { return "PUBLIC KEY", "PRIVATE KEY" }
+func (sm2Suite) PublicKeySize() int         { return sm2PublicKeyLength }
+func (sm2Suite) LayerOverhead() int         { return sm2EphemeralKey + SizeTag }
+func (sm2Suite) KeySize() int               { return sm2KeySize }
+func (sm2Suite) Hash(data []byte) []byte    { return sm3.Sm3Sum(data) }
+
+func (sm2Suite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealLayer agrees a key with publicKey over a fresh ephemeral key pair;
+// the shared point gives the key the layer is sealed with and the key the
+// reply is sealed with.
+func (s sm2Suite) SealLayer(publicKey PublicKey, ad, payload []byte) ([]byte, []byte, error) {
+	pub, ok := publicKey.(*sm2PublicKey)
+	if !ok {
+		return nil, nil, errWrongSuite
+	}
+	ephemeral, err := sm2.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	x, y := pub.key.Curve.ScalarMult(pub.key.X, pub.key.Y, ephemeral.D.Bytes())
+	ephemeralKey := marshalPoint(ephemeral.X, ephemeral.Y)
+	key, replyKey := s.layerKeys(marshalPoint(x, y), ephemeralKey)
+
+	aead, err := s.NewAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	layer := make([]byte, sm2EphemeralKey, s.LayerOverhead()+len(payload))
+	copy(layer, ephemeralKey)
+	return aead.Seal(layer, nonce, payload, ad), replyKey, nil
+}
+
+func (s sm2Suite) OpenLayer(privateKey PrivateKey, ad, layer []byte) ([]byte, []byte, error) {
+	priv, ok := privateKey.(*sm2PrivateKey)
+	if !ok {
+		return nil, nil, errWrongSuite
+	}
+	if len(layer) < s.LayerOverhead() {
+		return nil, nil, errors.New("layer too short")
+	}
+	ephemeralKey := layer[:sm2EphemeralKey]
+	ex := new(big.Int).SetBytes(ephemeralKey[:sm2EphemeralKey/2])
+	ey := new(big.Int).SetBytes(ephemeralKey[sm2EphemeralKey/2:])
+	if !priv.key.Curve.IsOnCurve(ex, ey) {
+		return nil, nil, errors.New("ephemeral key is not on the curve")
+	}
+	x, y := priv.key.Curve.ScalarMult(ex, ey, priv.key.D.Bytes())
+	key, replyKey := s.layerKeys(marshalPoint(x, y), ephemeralKey)
+
+	aead, err := s.NewAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	payload, err := aead.Open(nil, nonce, layer[sm2EphemeralKey:], ad)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, replyKey, nil
+}
+
+// layerKeys derives the key a layer is sealed with and the key its reply
+// is sealed with from the point shared through ephemeralKey. Both are
+// used exactly once, so a fixed nonce is safe.
+func (s sm2Suite) layerKeys(shared, ephemeralKey []byte) ([]byte, []byte) {
+	buf := append(append([]byte{}, shared...), ephemeralKey...)
+	key := s.Hash(append([]byte("layer"), buf...))[:sm2KeySize]
+	replyKey := s.Hash(append([]byte("reply"), buf...))[:sm2KeySize]
+	return key, replyKey
+}
+
+// SharedSecret is the x coordinate of the ECDH point.
+func (sm2Suite) SharedSecret(privateKey PrivateKey, peer PublicKey) ([]byte, error) {
+	priv, ok := privateKey.(*sm2PrivateKey)
+	pub, ok2 := peer.(*sm2PublicKey)
+	if !ok || !ok2 {
+		return nil, errWrongSuite
+	}
+	x, _ := priv.key.Curve.ScalarMult(pub.key.X, pub.key.Y, priv.key.D.Bytes())
+	secret := make([]byte, 32)
+	xbuf := x.Bytes()
+	copy(secret[32-len(xbuf):], xbuf)
+	return secret, nil
+}
+
+func (sm2Suite) Sign(privateKey PrivateKey, msg []byte) ([]byte, error) {
+	priv, ok := privateKey.(*sm2PrivateKey)
+	if !ok {
+		return nil, errWrongSuite
+	}
+	return priv.key.Sign(rand.Reader, msg, nil)
+}
+
+func (sm2Suite) Verify(publicKey PublicKey, msg, signature []byte) bool {
+	pub, ok := publicKey.(*sm2PublicKey)
+	if !ok {
+		return false
+	}
+	return pub.key.Verify(msg, signature)
+}
+
+func marshalPoint(x, y *big.Int) []byte {
+	buf := make([]byte, sm2EphemeralKey)
+	xbuf, ybuf := x.Bytes(), y.Bytes()
+	copy(buf[sm2EphemeralKey/2-len(xbuf):], xbuf)
+	copy(buf[sm2EphemeralKey-len(ybuf):], ybuf)
+	return buf
+}
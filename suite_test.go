@@ -0,0 +1,40 @@
+package vuvuzela
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLayerBindsAD(t *testing.T) {
+	payload := []byte("hello layer")
+	// longer than a nonce, differing only at the end
+	ad := []byte("vuvuzela hop link hello 10.0.0.1:2718 10.0.0.2:2718")
+	other := append([]byte(nil), ad...)
+	other[len(other)-1]++
+
+	for _, suite := range Suites {
+		priv, err := suite.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, sealKey, err := suite.SealLayer(priv.Public(), ad, payload)
+		if err != nil {
+			t.Fatalf("%s: %s", suite.Name(), err)
+		}
+		if len(layer) != len(payload)+suite.LayerOverhead() {
+			t.Fatalf("%s: layer is %d bytes, want %d", suite.Name(), len(layer), len(payload)+suite.LayerOverhead())
+		}
+
+		opened, openKey, err := suite.OpenLayer(priv, ad, layer)
+		if err != nil {
+			t.Fatalf("%s: %s", suite.Name(), err)
+		}
+		if !bytes.Equal(opened, payload) || !bytes.Equal(openKey, sealKey) {
+			t.Fatalf("%s: layer opened to %q", suite.Name(), opened)
+		}
+
+		if _, _, err := suite.OpenLayer(priv, other, layer); err == nil {
+			t.Fatalf("%s: layer opened with other ad", suite.Name())
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package vuvuzela
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+const (
+	x25519KeySize = 32
+)
+
+// X25519Suite builds a network the way the original Vuvuzela does:
+// Curve25519 for key agreement with NaCl box sealing, Ed25519 for
+// signatures and SHA-256 for hashing. A key is an X25519 key and an
+// Ed25519 key side by side.
+var X25519Suite CryptoSuite = x25519Suite{}
+
+type x25519Suite struct{}
+
+type x25519PublicKey struct {
+	box  *ecdh.PublicKey
+	sign ed25519.PublicKey
+}
+
+type x25519PrivateKey struct {
+	box    *ecdh.PrivateKey
+	sign   ed25519.PrivateKey
+	public *x25519PublicKey
+}
+
+func (k *x25519PublicKey) Bytes() []byte {
+	return append(k.box.Bytes(), k.sign...)
+}
+
+func (k *x25519PrivateKey) Bytes() []byte {
+	return append(k.box.Bytes(), k.sign.Seed()...)
+}
+
+func (k *x25519PrivateKey) Public() PublicKey { return k.public }
+
+func (x25519Suite) Name() string { return "x25519" }
+
+func (s x25519Suite) GenerateKey() (PrivateKey, error) {
+	buf := make([]byte, 2*x25519KeySize)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return s.ParsePrivateKey(buf)
+}
+
+func (x25519Suite) ParsePublicKey(buf []byte) (PublicKey, error) {
+	if len(buf) != 2*x25519KeySize {
+		return nil, errors.New("wrong x25519 public key size")
+	}
+	box, err := ecdh.X25519().NewPublicKey(buf[:x25519KeySize])
+	if err != nil {
+		return nil, err
+	}
+	sign := ed25519.PublicKey(append([]byte{}, buf[x25519KeySize:]...))
+	return &x25519PublicKey{box: box, sign: sign}, nil
+}
+
+func (x25519Suite) ParsePrivateKey(buf []byte) (PrivateKey, error) {
+	if len(buf) != 2*x25519KeySize {
+		return nil, errors.New("wrong x25519 private key size")
+	}
+	box, err := ecdh.X25519().NewPrivateKey(buf[:x25519KeySize])
+	if err != nil {
+		return nil, err
+	}
+	sign := ed25519.NewKeyFromSeed(buf[x25519KeySize:])
+	public := &x25519PublicKey{
+		box:  box.PublicKey(),
+		sign: sign.Public().(ed25519.PublicKey),
+	}
+	return &x25519PrivateKey{box: box, sign: sign, public: public}, nil
+}
+
+func (x25519Suite) PEMTypes() (string, string) {
+	return "VUVUZELA X25519 PUBLIC KEY", "VUVUZELA X25519 PRIVATE KEY"
+}
+func (x25519Suite) PublicKeySize() int { return 2 * x25519KeySize }
+func (x25519Suite) LayerOverhead() int { return x25519KeySize + secretbox.Overhead }
+func (x25519Suite) KeySize() int       { return x25519KeySize }
+
+func (x25519Suite) Hash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func (x25519Suite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != x25519KeySize {
+		return nil, errors.New("wrong secretbox key size")
+	}
+	aead := new(secretboxAEAD)
+	copy(aead.key[:], key)
+	return aead, nil
+}
+
+// SealLayer is a NaCl box from a fresh ephemeral key to publicKey, with
+// the hash of ad as the nonce, the way Vuvuzela uses the round number;
+// every ephemeral key is used once, so the nonce does not have to be
+// random.
+func (s x25519Suite) SealLayer(publicKey PublicKey, ad, payload []byte) ([]byte, []byte, error) {
+	pub, ok := publicKey.(*x25519PublicKey)
+	if !ok {
+		return nil, nil, errWrongSuite
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := ephemeral.ECDH(pub.box)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeralKey := ephemeral.PublicKey().Bytes()
+	key := boxKey(shared)
+	nonce := layerNonce(ad)
+	layer := secretbox.Seal(ephemeralKey, payload, &nonce, &key)
+	return layer, s.replyKey(key[:], ephemeralKey), nil
+}
+
+func (s x25519Suite) OpenLayer(privateKey PrivateKey, ad, layer []byte) ([]byte, []byte, error) {
+	priv, ok := privateKey.(*x25519PrivateKey)
+	if !ok {
+		return nil, nil, errWrongSuite
+	}
+	if len(layer) < s.LayerOverhead() {
+		return nil, nil, errors.New("layer too short")
+	}
+	ephemeralKey := layer[:x25519KeySize]
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := priv.box.ECDH(ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := boxKey(shared)
+	nonce := layerNonce(ad)
+	payload, ok := secretbox.Open(nil, layer[x25519KeySize:], &nonce, &key)
+	if !ok {
+		return nil, nil, errors.New("layer does not open")
+	}
+	return payload, s.replyKey(key[:], ephemeralKey), nil
+}
+
+func (s x25519Suite) replyKey(key, ephemeralKey []byte) []byte {
+	buf := append([]byte("reply"), key...)
+	return s.Hash(append(buf, ephemeralKey...))
+}
+
+func (x25519Suite) SharedSecret(privateKey PrivateKey, peer PublicKey) ([]byte, error) {
+	priv, ok := privateKey.(*x25519PrivateKey)
+	pub, ok2 := peer.(*x25519PublicKey)
+	if !ok || !ok2 {
+		return nil, errWrongSuite
+	}
+	return priv.box.ECDH(pub.box)
+}
+
+func (x25519Suite) Sign(privateKey PrivateKey, msg []byte) ([]byte, error) {
+	priv, ok := privateKey.(*x25519PrivateKey)
+	if !ok {
+		return nil, errWrongSuite
+	}
+	return ed25519.Sign(priv.sign, msg), nil
+}
+
+func (x25519Suite) Verify(publicKey PublicKey, msg, signature []byte) bool {
+	pub, ok := publicKey.(*x25519PublicKey)
+	if !ok {
+		return false
+	}
+	return ed25519.Verify(pub.sign, msg, signature)
+}
+
+// boxKey is what NaCl's box.Precompute makes of an X25519 shared secret.
+func boxKey(shared []byte) [32]byte {
+	var key, in [32]byte
+	var zeros [16]byte
+	copy(in[:], shared)
+	salsa.HSalsa20(&key, &zeros, &in, &salsa.Sigma)
+	return key
+}
+
+// layerNonce hashes all of ad into the nonce, so a layer opens only with
+// the ad it was sealed with however long it is.
+func layerNonce(ad []byte) [24]byte {
+	var nonce [24]byte
+	sum := sha256.Sum256(ad)
+	copy(nonce[:], sum[:])
+	return nonce
+}
+
+// secretboxAEAD is NaCl secretbox behind cipher.AEAD, with the nonce size
+// of the other suites. The rest of the secretbox nonce is taken from the
+// hash of the additional data, so opening with other additional data
+// fails like it does with a real AEAD.
+type secretboxAEAD struct {
+	key [32]byte
+}
+
+func (a *secretboxAEAD) NonceSize() int { return SizeNonce }
+func (a *secretboxAEAD) Overhead() int  { return secretbox.Overhead }
+
+func (a *secretboxAEAD) nonce(nonce, ad []byte) *[24]byte {
+	var n [24]byte
+	copy(n[:], nonce)
+	sum := sha256.Sum256(ad)
+	copy(n[SizeNonce:], sum[:])
+	return &n
+}
+
+func (a *secretboxAEAD) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	return secretbox.Seal(dst, plaintext, a.nonce(nonce, ad), &a.key)
+}
+
+func (a *secretboxAEAD) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	out, ok := secretbox.Open(dst, ciphertext, a.nonce(nonce, ad), &a.key)
+	if !ok {
+		return nil, errors.New("secretbox: message authentication failed")
+	}
+	return out, nil
+}
@@ -0,0 +1,92 @@
+package vuvuzela
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Topology describes the chain of servers a message travels through,
+// from the entry server that clients connect to down to the last hop.
+type Topology struct {
+	Servers []*ServerInfo
+}
+
+// ServerInfo is where a server of the chain takes messages and hands out
+// its doctrine.
+type ServerInfo struct {
+	Name         string
+	MessageAddr  string
+	DoctrineAddr string
+}
+
+// LoadTopology reads the topology file at path. If chain is not empty it
+// takes precedence over the file; it is a comma separated list of
+// messageaddr/doctrineaddr pairs, e.g. "host:2719/host:2718,host:20006/host:3456".
+func LoadTopology(path, chain string) (*Topology, error) {
+	topology := new(Topology)
+	if chain != "" {
+		for i, hop := range strings.Split(chain, ",") {
+			addrs := strings.Split(strings.TrimSpace(hop), "/")
+			if len(addrs) != 2 {
+				return nil, fmt.Errorf("bad chain hop %q: expected messageaddr/doctrineaddr", hop)
+			}
+			topology.Servers = append(topology.Servers, &ServerInfo{
+				Name:         fmt.Sprintf("hop%d", i),
+				MessageAddr:  addrs[0],
+				DoctrineAddr: addrs[1],
+			})
+		}
+	} else {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, topology)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(topology.Servers) < 2 {
+		return nil, fmt.Errorf("topology needs at least 2 servers, got %d", len(topology.Servers))
+	}
+	for i, server := range topology.Servers {
+		if server.MessageAddr == "" || server.DoctrineAddr == "" {
+			return nil, fmt.Errorf("server %d (%s) is missing an address", i, server.Name)
+		}
+	}
+	return topology, nil
+}
+
+// Entry is the server clients connect to.
+func (t *Topology) Entry() *ServerInfo {
+	return t.Servers[0]
+}
+
+// Last is the server that runs the dead drops.
+func (t *Topology) Last() *ServerInfo {
+	return t.Servers[len(t.Servers)-1]
+}
+
+// RoleOf is the role of the server at position hop of the chain.
+func (t *Topology) RoleOf(hop int) string {
+	switch hop {
+	case 0:
+		return RoleEntry
+	case len(t.Servers) - 1:
+		return RoleLast
+	}
+	return RoleMix
+}
+
+// ListenAddr turns a public host:port into the address to bind locally.
+func ListenAddr(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ":" + port
+}